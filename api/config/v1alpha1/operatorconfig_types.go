@@ -0,0 +1,95 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+//+kubebuilder:object:root=true
+
+// OperatorConfig is the Schema for the operator configuration file
+type OperatorConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ControllerManagerConfigurationSpec returns the configurations for controllers
+	cfg.ControllerManagerConfigurationSpec `json:",inline"`
+
+	// AgentDefaults are inherited by Agents that do not override them
+	AgentDefaults AgentDefaults `json:"agentDefaults,omitempty"`
+}
+
+// AgentDefaults are the operator wide defaults of the Agent settings
+type AgentDefaults struct {
+	// Image is the default Agent image
+	Image string `json:"image,omitempty"`
+	// Resources are the default compute resources of the agent container
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Proxy is the default proxy configuration, each setting is
+	// inherited separately
+	Proxy azdevopsv1alpha1.ProxyConfig `json:"proxy,omitempty"`
+	// ClusterNoProxy are the cluster internal CIDRs and domains, like the
+	// pod and service CIDRs, appended to the NO_PROXY of Agents using a proxy
+	ClusterNoProxy []string `json:"clusterNoProxy,omitempty"`
+	// CABundle contains PEM encoded certificates the agents trust in
+	// addition to the image defaults, for example of a TLS inspecting proxy
+	CABundle string `json:"caBundle,omitempty"`
+	// SecurityProfile is the default security profile of the agent pods
+	SecurityProfile azdevopsv1alpha1.SecurityProfile `json:"securityProfile,omitempty"`
+	// AllowedRegistries restricts the Agent images to these registries or
+	// repository prefixes, all images are allowed when empty
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+	// AllowedRBACNamespaces are the namespaces other than their own the
+	// Agents can be granted access to through rbac or an environment
+	AllowedRBACNamespaces []string `json:"allowedRBACNamespaces,omitempty"`
+	// AllowedClusterRoles are the ClusterRoles the Agents can bind in their
+	// target namespaces, the manager role needs bind on each of them
+	AllowedClusterRoles []string `json:"allowedClusterRoles,omitempty"`
+	// AllowedRBACRules are the permissions the Agents can be granted with
+	// inline rules, every permission of a rule must be part of one of them.
+	// Inline rules are refused when empty, the manager role needs the
+	// permissions itself to grant them.
+	AllowedRBACRules []rbacv1.PolicyRule `json:"allowedRBACRules,omitempty"`
+	// ACRClientID and ACRTenantID select the Azure AD application the
+	// operator obtains Azure Container Registry tokens for, the client and
+	// tenant id of the operator workload identity when empty
+	ACRClientID string `json:"acrClientID,omitempty"`
+	ACRTenantID string `json:"acrTenantID,omitempty"`
+	// AllowedACRRegistries are the registry login servers the operator
+	// obtains tokens for with its Azure AD application, per namespace of
+	// the Agents. Registries that are not listed are refused.
+	AllowedACRRegistries []ACRRegistryGrant `json:"allowedACRRegistries,omitempty"`
+}
+
+// ACRRegistryGrant allows the Agents in a set of namespaces to obtain
+// tokens for a set of Azure Container Registries
+type ACRRegistryGrant struct {
+	// Namespaces of the Agents, the grant applies to all namespaces when
+	// empty
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Registries are the login servers, like myregistry.azurecr.io
+	Registries []string `json:"registries"`
+}
+
+func init() {
+	SchemeBuilder.Register(&OperatorConfig{})
+}
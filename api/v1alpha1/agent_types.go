@@ -17,7 +17,11 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // AgentSpec defines the desired state of Agent
@@ -25,8 +29,19 @@ type AgentSpec struct {
 	//+kubebuilder:validation:Minimum=0
 	// Size is the size of the Agent deployment
 	Size int32 `json:"size"`
+	// Schedules override Size while one of them is active, the first active
+	// schedule in the list wins when windows overlap. Outside all windows
+	// Size applies, so anything that scales the Agent by changing Size only
+	// has effect outside the windows. Schedules are not applied while
+	// another manager owns the replicas of the Deployment.
+	Schedules []ScheduleConfig `json:"schedules,omitempty"`
+	// ProfileRef references the AgentProfile the Agent inherits its
+	// settings from, settings set on the Agent override the profile
+	ProfileRef *AgentProfileReference `json:"profileRef,omitempty"`
 	// Image when provided overrides the default Agent image
 	Image string `json:"image,omitempty"`
+	// Resources when provided overrides the default compute resources of the agent
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
 	// AzureDevPortal is configuring the Azure DevOps pool settings of the Agent
 	// by using additional environment variables.
 	Pool AzDevPool `json:"pool"`
@@ -35,16 +50,98 @@ type AgentSpec struct {
 	// Allow specifying MTU value for networks used by container jobs
 	// useful for docker-in-docker scenarios in k8s cluster
 	MTUValue string `json:"mtuValue,omitempty"`
-	// SSH key to authenticate with pipe-line agent targets
+	// ScaleDown controls how agents are removed when the size is reduced
+	ScaleDown ScaleDownPolicy `json:"scaleDown,omitempty"`
+	// Disruption when provided creates a PodDisruptionBudget for the agents
+	Disruption *DisruptionConfig `json:"disruption,omitempty"`
+	// NetworkPolicy when provided restricts the network traffic of the agents
+	NetworkPolicy *NetworkPolicyConfig `json:"networkPolicy,omitempty"`
+	// RBAC when provided runs the agents under a dedicated ServiceAccount
+	// that is granted access to the target namespaces
+	RBAC *RBACConfig `json:"rbac,omitempty"`
+	// SecurityProfile hardens the security context of the agent pods,
+	// when empty the image defaults are used
+	SecurityProfile SecurityProfile `json:"securityProfile,omitempty"`
+	// RuntimeClassName runs the agent pods with a sandboxed container
+	// runtime like gVisor, Kata or sysbox
+	RuntimeClassName *string `json:"runtimeClassName,omitempty"`
+	// Environment when provided registers a namespace as Kubernetes
+	// resource in an Azure DevOps Environment
+	Environment *EnvironmentConfig `json:"environment,omitempty"`
+	// Paused stops the reconciliation of the owned resources, the
+	// azdevops.gofound.nl/paused annotation pauses the Agent as well
+	Paused bool `json:"paused,omitempty"`
+	// Maintenance disables the agents in Azure DevOps so they receive no
+	// new jobs while their pods keep running, the
+	// azdevops.gofound.nl/maintenance annotation enables it as well
+	Maintenance bool `json:"maintenance,omitempty"`
+	// AgentVersion when provided selects the agent software version the
+	// pods install. The version is passed in AZP_AGENT_VERSION and
+	// AZP_AGENT_PACKAGE_URL with AZP_AGENT_DISABLEUPDATE=true, which only
+	// take effect with an agent image that installs that package and
+	// configures the agent with --disableupdate. The autoUpdate of a pool
+	// that is not managed by an AgentPool has to be disabled in Azure DevOps.
+	AgentVersion *AgentVersionConfig `json:"agentVersion,omitempty"`
+	// Rollout when provided moves a few canary agents to a changed image
+	// first and promotes or rolls back the image based on the job results
+	// of the canaries
+	Rollout *RolloutConfig `json:"rollout,omitempty"`
+	// Caches when provided shares the tool and package caches between the
+	// agents on a ReadWriteMany volume or a node-local directory
+	Caches *CachesConfig `json:"caches,omitempty"`
+	// Tools are copied from their images into a directory on the PATH of
+	// the agents by init containers, so the agent image does not need them.
+	// The init containers run /bin/sh and cp in the tool image, distroless
+	// and scratch images can not be used. A failing copy is reported in the
+	// ToolsInstalled condition.
+	//+listType=map
+	//+listMapKey=name
+	Tools []Tool `json:"tools,omitempty"`
+	// Env is added to the environment of the agent container, variables
+	// set by the operator are overridden
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// EnvFrom adds the keys of ConfigMaps and Secrets to the environment
+	// of the agent container
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+	// Volumes are added to the agent pods
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+	// VolumeMounts are added to the agent container
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+	// StartupScripts when provided runs the scripts of a ConfigMap before
+	// the agent is started
+	StartupScripts *StartupScriptsConfig `json:"startupScripts,omitempty"`
+	// SSH when provided installs the SSH keys the agents authenticate
+	// with at pipeline targets
+	SSH *SSHConfig `json:"ssh,omitempty"`
+	// ImagePullSecrets are used to pull the images of the agent pods
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// DockerConfig when provided mounts a docker config.json with registry
+	// credentials for the container jobs of the agents
+	DockerConfig *DockerConfig `json:"dockerConfig,omitempty"`
+}
+
+// reference a cluster scoped AgentProfile
+type AgentProfileReference struct {
+	// Name of the AgentProfile
+	Name string `json:"name"`
 }
 
 // control the pool and agent work directory
 type AzDevPool struct {
-	URL       string `json:"url"`
-	Token     string `json:"token"`
-	PoolName  string `json:"poolName"`
+	URL       string `json:"url,omitempty"`
+	Token     string `json:"token,omitempty"`
+	PoolName  string `json:"poolName,omitempty"`
 	AgentName string `json:"agentName,omitempty"`
 	WorkDir   string `json:"workDir,omitempty"`
+	// AgentPoolRef references an AgentPool in the namespace of the Agent,
+	// the url, token and pool name of the AgentPool are used instead
+	AgentPoolRef *AgentPoolReference `json:"agentPoolRef,omitempty"`
+}
+
+// reference to an AgentPool in the namespace of the Agent
+type AgentPoolReference struct {
+	// Name of the AgentPool
+	Name string `json:"name"`
 }
 
 // control the proxy configuration of the agent
@@ -53,6 +150,285 @@ type ProxyConfig struct {
 	HTTPSProxy string `json:"httpsProxy,omitempty"`
 	FTPProxy   string `json:"ftpProxy,omitempty"`
 	NoProxy    string `json:"noProxy,omitempty"`
+	// CredentialsSecretRef references a Secret in the namespace of the
+	// Agent with the username and password keys of an authenticated proxy
+	CredentialsSecretRef *corev1.LocalObjectReference `json:"credentialsSecretRef,omitempty"`
+}
+
+// control how agents are removed when the Agent is scaled down
+type ScaleDownPolicy struct {
+	//+kubebuilder:validation:Minimum=0
+	// GracePeriodSeconds is the time a busy agent gets to finish its
+	// current job after the pod is asked to terminate, defaults to 3600
+	GracePeriodSeconds *int64 `json:"gracePeriodSeconds,omitempty"`
+}
+
+// control the PodDisruptionBudget of the agents, only one of
+// MinAvailable and MaxUnavailable can be set
+type DisruptionConfig struct {
+	// MinAvailable is the number or percentage of agents that must remain
+	// available during a voluntary disruption, a number or percentage of
+	// the size or more is capped to one below the size so a node can always
+	// be drained
+	MinAvailable *intstr.IntOrString `json:"minAvailable,omitempty"`
+	// MaxUnavailable is the number or percentage of agents that can be
+	// unavailable during a voluntary disruption, defaults to 1
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+}
+
+// control the NetworkPolicy of the agents, all ingress is denied and
+// egress is only allowed to the cluster DNS, the proxies addressed by IP and
+// the declared CIDRs and namespaces
+type NetworkPolicyConfig struct {
+	// AllowedCIDRs are the IP ranges the agents can connect to, agents
+	// that do not use a proxy need the Azure DevOps ranges or 0.0.0.0/0,
+	// a proxy addressed by host name needs its addresses
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+	// AllowedNamespaces are the namespaces the agents can connect to
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+}
+
+// control the permissions of the agents for in-cluster deployments
+type RBACConfig struct {
+	// Namespaces the agents are granted access to, namespaces other than
+	// the Agent namespace must be allowed by the operator configuration
+	Namespaces []TargetNamespace `json:"namespaces,omitempty"`
+}
+
+// grant the agents access to a namespace
+type TargetNamespace struct {
+	// Name of the target namespace
+	Name string `json:"name"`
+	// Rules are granted in the target namespace through a Role
+	Rules []rbacv1.PolicyRule `json:"rules,omitempty"`
+	// ClusterRoles are bound in the target namespace through RoleBindings,
+	// only ClusterRoles allowed by the operator configuration can be bound
+	ClusterRoles []string `json:"clusterRoles,omitempty"`
+}
+
+// SecurityProfile is a predefined set of pod and container security settings
+//+kubebuilder:validation:Enum=restricted;baseline;privileged-dind
+type SecurityProfile string
+
+const (
+	// SecurityProfileRestricted runs the agent as non-root with all
+	// capabilities dropped, the runtime default seccomp profile and a
+	// read-only root filesystem, matching the restricted Pod Security Standard
+	SecurityProfileRestricted SecurityProfile = "restricted"
+	// SecurityProfileBaseline prevents privilege escalation and applies the
+	// runtime default seccomp profile, matching the baseline Pod Security Standard
+	SecurityProfileBaseline SecurityProfile = "baseline"
+	// SecurityProfilePrivilegedDind runs the agent privileged for
+	// docker-in-docker builds
+	SecurityProfilePrivilegedDind SecurityProfile = "privileged-dind"
+)
+
+// control the size of the agents during a recurring time window
+type ScheduleConfig struct {
+	// Name of the schedule, shown in the status while it is active
+	Name string `json:"name"`
+	// Start is a standard five field cron expression opening the window
+	Start string `json:"start"`
+	// Duration of the window, like 10h
+	Duration metav1.Duration `json:"duration"`
+	// TimeZone the start expression is evaluated in, like Europe/Amsterdam,
+	// defaults to UTC
+	TimeZone string `json:"timeZone,omitempty"`
+	// Size of the Agent deployment while the window is open
+	// +kubebuilder:validation:Minimum=0
+	Size int32 `json:"size"`
+}
+
+// control the Azure DevOps Environment the target namespace is registered in
+type EnvironmentConfig struct {
+	// Project is the Azure DevOps project of the Environment
+	Project string `json:"project"`
+	// Name of the Environment, it is created when it does not exist
+	Name string `json:"name"`
+	// Namespace registered as Kubernetes resource, defaults to the
+	// namespace of the Agent. Other namespaces must be allowed by the
+	// operator configuration.
+	Namespace string `json:"namespace,omitempty"`
+	// ClusterName shown for the resource in Azure DevOps
+	// +kubebuilder:default=kubernetes
+	ClusterName string `json:"clusterName,omitempty"`
+	// ClusterURL is the API server url pipelines use to deploy to the
+	// namespace, the agents reach the in-cluster url by default
+	// +kubebuilder:default="https://kubernetes.default.svc"
+	ClusterURL string `json:"clusterUrl,omitempty"`
+	// ClusterRole granted to the generated ServiceAccount in the namespace,
+	// it must be one of the ClusterRoles allowed by the operator configuration
+	// +kubebuilder:default=edit
+	ClusterRole string `json:"clusterRole,omitempty"`
+}
+
+// AgentVersionPolicy selects the agent software version from the agent
+// packages published in Azure DevOps
+//+kubebuilder:validation:Enum=Pinned;TrackLatest;TrackMinor
+type AgentVersionPolicy string
+
+const (
+	// AgentVersionPinned installs exactly the configured version
+	AgentVersionPinned AgentVersionPolicy = "Pinned"
+	// AgentVersionTrackLatest installs the latest published version
+	AgentVersionTrackLatest AgentVersionPolicy = "TrackLatest"
+	// AgentVersionTrackMinor installs the latest patch release of the
+	// configured major.minor version
+	AgentVersionTrackMinor AgentVersionPolicy = "TrackMinor"
+)
+
+// control the agent software version installed in the agent pods
+type AgentVersionConfig struct {
+	// Policy selects the version, the pods are rolled when the selected
+	// version changes
+	// +kubebuilder:default=TrackLatest
+	Policy AgentVersionPolicy `json:"policy,omitempty"`
+	// Version is the pinned version, like 2.195.2, or the major.minor
+	// version tracked by TrackMinor, like 2.195. TrackMinor without version
+	// tracks the minor version that is installed first.
+	Version string `json:"version,omitempty"`
+	// Platform of the agent package
+	// +kubebuilder:default=linux-x64
+	Platform string `json:"platform,omitempty"`
+}
+
+// control the canary rollout of image changes
+type RolloutConfig struct {
+	// CanaryAgents is the number of agents that run the new image next to
+	// the agents running the stable image
+	// +kubebuilder:default=1
+	// +kubebuilder:validation:Minimum=1
+	CanaryAgents int32 `json:"canaryAgents,omitempty"`
+	// Jobs is the number of jobs the canaries complete before the success
+	// rate is evaluated
+	// +kubebuilder:default=3
+	// +kubebuilder:validation:Minimum=1
+	Jobs int32 `json:"jobs,omitempty"`
+	// SuccessRate is the percentage of the canary jobs that has to succeed
+	// to promote the new image
+	// +kubebuilder:default=90
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	SuccessRate int32 `json:"successRate,omitempty"`
+	// Timeout rolls back the new image when the canaries did not complete
+	// enough jobs in time, like 2h
+	// +kubebuilder:default="1h"
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// RolloutPhase is the state of the canary rollout
+type RolloutPhase string
+
+const (
+	// RolloutStable means all agents run the stable image
+	RolloutStable RolloutPhase = "Stable"
+	// RolloutProgressing means the canaries run the new image
+	RolloutProgressing RolloutPhase = "Progressing"
+	// RolloutRolledBack means the new image failed and all agents run the
+	// stable image until the image is changed again
+	RolloutRolledBack RolloutPhase = "RolledBack"
+)
+
+// Cache is a tool or package cache the agents share
+//+kubebuilder:validation:Enum=tools;nuget;npm;maven
+type Cache string
+
+const (
+	// CacheTools is the tool cache of the tool installer tasks, like Node
+	// and .NET, set as AGENT_TOOLSDIRECTORY
+	CacheTools Cache = "tools"
+	// CacheNuGet is the NuGet global packages folder, set as NUGET_PACKAGES
+	CacheNuGet Cache = "nuget"
+	// CacheNpm is the npm cache, set as npm_config_cache
+	CacheNpm Cache = "npm"
+	// CacheMaven is the Maven local repository, which is not safe for
+	// concurrent use so every agent pod gets its own subpath
+	CacheMaven Cache = "maven"
+)
+
+// control the shared tool and package caches of the agents, exactly one of
+// claimName, storage and hostPath is set
+type CachesConfig struct {
+	// Caches lists the caches stored on the volume, all when empty
+	Caches []Cache `json:"caches,omitempty"`
+	// ClaimName references an existing ReadWriteMany PersistentVolumeClaim
+	ClaimName string `json:"claimName,omitempty"`
+	// Storage provisions a ReadWriteMany PersistentVolumeClaim of this size
+	// named <agent>-cache, it is deleted with the Agent
+	Storage *resource.Quantity `json:"storage,omitempty"`
+	// StorageClassName of the provisioned claim
+	StorageClassName *string `json:"storageClassName,omitempty"`
+	// HostPath is a directory on the node shared by the agents running on
+	// that node, it requires the privileged pod security level
+	HostPath string `json:"hostPath,omitempty"`
+}
+
+// a CLI copied from an OCI image into the agent pods
+type Tool struct {
+	//+kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	//+kubebuilder:validation:MaxLength=58
+	// Name of the tool, the init container is named tool-<name>
+	Name string `json:"name"`
+	// Image containing the tool, it needs a shell and cp to copy the tool
+	Image string `json:"image"`
+	//+kubebuilder:validation:Pattern=`^/`
+	// Path of the executable in the image, the content of a directory is
+	// copied when the path is a directory
+	Path string `json:"path"`
+}
+
+// run the scripts of a ConfigMap in the agent container before the agent
+// starts, a failing script stops the container
+type StartupScriptsConfig struct {
+	// ConfigMapName is the name of the ConfigMap holding the scripts
+	ConfigMapName string `json:"configMapName"`
+	// Keys are the scripts run in order, all keys of the ConfigMap in
+	// alphabetical order when empty
+	Keys []string `json:"keys,omitempty"`
+	// Entrypoint is the command starting the agent after the scripts, the
+	// ./start.sh of the agent image when empty
+	Entrypoint []string `json:"entrypoint,omitempty"`
+}
+
+// control the SSH keys and known hosts of the agents
+type SSHConfig struct {
+	// SecretName is the Secret holding the private keys, the known_hosts
+	// and config keys are installed as known_hosts and config
+	SecretName string `json:"secretName"`
+	// KnownHostsConfigMapName when provided installs the known_hosts key
+	// of the ConfigMap instead of the one in the Secret
+	KnownHostsConfigMapName string `json:"knownHostsConfigMapName,omitempty"`
+	// Path is the .ssh directory in the home of the agent user, /root/.ssh
+	// when empty
+	Path string `json:"path,omitempty"`
+	// Agent when provided loads the private keys in an ssh-agent sidecar
+	// instead of installing them in the .ssh directory
+	Agent *SSHAgentConfig `json:"agent,omitempty"`
+}
+
+// control the ssh-agent sidecar of the agent pods
+type SSHAgentConfig struct {
+	// Image of the sidecar, it needs ssh-agent, ssh-add and pgrep. The
+	// Agent image when empty.
+	Image string `json:"image,omitempty"`
+}
+
+// control the docker config.json of the agents, exactly one of secretName
+// and acr is set
+type DockerConfig struct {
+	// SecretName references a kubernetes.io/dockerconfigjson Secret
+	SecretName string `json:"secretName,omitempty"`
+	// ACR generates the config.json from tokens of Azure Container
+	// Registries obtained with the workload identity of the operator
+	ACR *ACRConfig `json:"acr,omitempty"`
+}
+
+// control the Azure Container Registries the agents log in to
+type ACRConfig struct {
+	//+kubebuilder:validation:MinItems=1
+	// Registries are the login servers, like myregistry.azurecr.io, the
+	// operator configuration has to allow them for the namespace
+	Registries []string `json:"registries"`
 }
 
 // AgentStatus defines the observed state of Agent
@@ -60,8 +436,127 @@ type AgentStatus struct {
 	// Agents contains the names of the Agent pods
 	// this verrifies the deployment
 	Agents []string `json:"agents,omitempty"`
+	// Conditions represent the latest available observations of the Agent state
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// ActiveSchedule is the name of the schedule that sets the size
+	ActiveSchedule string `json:"activeSchedule,omitempty"`
+	// LastJobFinishTime is the finish time of the last job exported in the
+	// job metrics, so jobs are exported once across operator restarts
+	LastJobFinishTime *metav1.MicroTime `json:"lastJobFinishTime,omitempty"`
+	// Environment contains the Azure DevOps ids of the registered namespace
+	Environment *EnvironmentStatus `json:"environment,omitempty"`
+	// AgentVersion is the agent software version selected for the pods
+	AgentVersion *AgentVersionStatus `json:"agentVersion,omitempty"`
+	// Rollout reports the canary rollout of the image
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+}
+
+// RolloutStatus reports the canary rollout of the image
+type RolloutStatus struct {
+	Phase RolloutPhase `json:"phase"`
+	// StableImage is the image the agents run outside the canaries
+	StableImage string `json:"stableImage"`
+	// CanaryImage is the image of the last rollout
+	CanaryImage string `json:"canaryImage,omitempty"`
+	// StartTime is when the canaries of the last rollout were started
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// SucceededJobs and FailedJobs count the completed jobs of the canaries
+	SucceededJobs int32 `json:"succeededJobs,omitempty"`
+	FailedJobs    int32 `json:"failedJobs,omitempty"`
+	// LastJobFinishTime is the finish time of the last canary job counted,
+	// later evaluations only count the jobs that finished after it
+	LastJobFinishTime *metav1.MicroTime `json:"lastJobFinishTime,omitempty"`
+	// Message explains the last phase change
+	Message string `json:"message,omitempty"`
 }
 
+// AgentVersionStatus records the selected agent package
+type AgentVersionStatus struct {
+	Version     string `json:"version"`
+	DownloadURL string `json:"downloadUrl"`
+}
+
+// EnvironmentStatus records the resources created in Azure DevOps so they
+// can be removed when the Agent is deleted
+type EnvironmentStatus struct {
+	Project           string `json:"project"`
+	ProjectID         string `json:"projectId"`
+	EnvironmentID     int    `json:"environmentId"`
+	Namespace         string `json:"namespace"`
+	ResourceID        int    `json:"resourceId,omitempty"`
+	ServiceEndpointID string `json:"serviceEndpointId,omitempty"`
+	// ServiceEndpointHash identifies the cluster URL and token the service
+	// endpoint was last updated with
+	ServiceEndpointHash string `json:"serviceEndpointHash,omitempty"`
+	// Environment is the name of the Environment the namespace is
+	// registered in
+	Environment string `json:"environment,omitempty"`
+}
+
+const (
+	// ConditionPodSecurity reports if the security profile is allowed by the
+	// Pod Security Admission level enforced on the namespace
+	ConditionPodSecurity = "PodSecurityCompatible"
+	// ConditionImageAllowed reports if the Agent image is pulled from one of
+	// the registries allowed by the operator configuration
+	ConditionImageAllowed = "ImageAllowed"
+	// ConditionProfileResolved reports if the referenced AgentProfile exists
+	ConditionProfileResolved = "ProfileResolved"
+	// ConditionPoolResolved reports if the referenced AgentPool exists and
+	// is provisioned in Azure DevOps
+	ConditionPoolResolved = "PoolResolved"
+	// ConditionEnvironmentRegistered reports if the namespace is registered
+	// in the Azure DevOps Environment
+	ConditionEnvironmentRegistered = "EnvironmentRegistered"
+	// ConditionSchedulesValid reports if the cron expressions and time zones
+	// of the schedules can be parsed
+	ConditionSchedulesValid = "SchedulesValid"
+	// ConditionSchedulesApplied reports if the operator scales the
+	// Deployment to the schedules, they are not applied once another
+	// manager like a HorizontalPodAutoscaler owns the replicas
+	ConditionSchedulesApplied = "SchedulesApplied"
+	// ConditionPaused reports if the reconciliation of the owned resources
+	// is paused
+	ConditionPaused = "Paused"
+	// ConditionMaintenance reports if the agents are disabled in Azure
+	// DevOps for maintenance
+	ConditionMaintenance = "Maintenance"
+	// ConditionAgentVersionResolved reports if the agent version policy
+	// resolved to a published agent package
+	ConditionAgentVersionResolved = "AgentVersionResolved"
+	// ConditionCachesReady reports if the cache volume is valid and exists
+	ConditionCachesReady = "CachesReady"
+	// ConditionToolsInstalled reports if the tools were copied from their
+	// images in the agent pods
+	ConditionToolsInstalled = "ToolsInstalled"
+	// ConditionStartupScriptsSucceeded reports if the startup scripts exist
+	// and did not fail in one of the agent pods
+	ConditionStartupScriptsSucceeded = "StartupScriptsSucceeded"
+	// ConditionProxyCredentialsResolved reports if the referenced proxy
+	// credentials Secret exists and holds a username and password
+	ConditionProxyCredentialsResolved = "ProxyCredentialsResolved"
+	// ConditionSSHKeysResolved reports if the referenced SSH Secret and
+	// known hosts ConfigMap exist
+	ConditionSSHKeysResolved = "SSHKeysResolved"
+	// ConditionDockerConfigReady reports if the docker config.json exists
+	// and its registry tokens are valid
+	ConditionDockerConfigReady = "DockerConfigReady"
+	// ConditionNetworkPolicyValid reports if the network policy settings
+	// are valid and the NetworkPolicy is applied
+	ConditionNetworkPolicyValid = "NetworkPolicyValid"
+	// ConditionRBACAllowed reports if the target namespaces and ClusterRoles
+	// are allowed by the operator configuration
+	ConditionRBACAllowed = "RBACAllowed"
+)
+
+const (
+	// PausedAnnotation set to true pauses the Agent like the paused setting
+	PausedAnnotation = "azdevops.gofound.nl/paused"
+	// MaintenanceAnnotation set to true enables the maintenance mode like
+	// the maintenance setting
+	MaintenanceAnnotation = "azdevops.gofound.nl/maintenance"
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 
@@ -0,0 +1,115 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AgentPoolSpec defines the desired state of AgentPool
+type AgentPoolSpec struct {
+	// URL of the Azure DevOps organization
+	URL string `json:"url"`
+	// Token is a personal access token allowed to manage agent pools
+	Token string `json:"token"`
+	// PoolName of the organization level pool, defaults to the AgentPool name
+	PoolName string `json:"poolName,omitempty"`
+	// AutoProvision makes the pool available in every new project
+	AutoProvision *bool `json:"autoProvision,omitempty"`
+	// AutoUpdate lets Azure DevOps update the agents in the pool
+	AutoUpdate *bool `json:"autoUpdate,omitempty"`
+	// Projects the pool is made available in
+	Projects []ProjectQueue `json:"projects,omitempty"`
+	//+kubebuilder:validation:Enum=Retain;Delete
+	// DeletionPolicy controls if the pool is deleted in Azure DevOps when
+	// the AgentPool is deleted, defaults to Retain. Pools that existed
+	// before the AgentPool adopted them are always retained.
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// make the pool available in a project
+type ProjectQueue struct {
+	// Name of the project
+	Name string `json:"name"`
+	// AuthorizeAllPipelines allows all pipelines in the project to use the pool
+	AuthorizeAllPipelines bool `json:"authorizeAllPipelines,omitempty"`
+}
+
+// DeletionPolicy controls what happens to the Azure DevOps pool when the
+// AgentPool is deleted
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyRetain keeps the pool in Azure DevOps
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+	// DeletionPolicyDelete deletes the pool and its project queues
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+)
+
+// AgentPoolStatus defines the observed state of AgentPool
+type AgentPoolStatus struct {
+	// PoolID is the id of the pool in Azure DevOps
+	PoolID int `json:"poolId,omitempty"`
+	// Created is true when the operator created the pool, only created
+	// pools are deleted with the Delete deletion policy
+	Created bool `json:"created,omitempty"`
+	// Queues contains the queue of the pool per project
+	Queues []ProjectQueueStatus `json:"queues,omitempty"`
+	// Conditions represent the latest available observations of the AgentPool state
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// the queue of the pool in a project
+type ProjectQueueStatus struct {
+	// Project name
+	Project string `json:"project"`
+	// QueueID is the id of the queue in the project
+	QueueID int `json:"queueId"`
+}
+
+const (
+	// ConditionPoolReady reports if the pool and its project queues are
+	// provisioned in Azure DevOps
+	ConditionPoolReady = "Ready"
+)
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Pool",type=string,JSONPath=`.spec.poolName`
+//+kubebuilder:printcolumn:name="Pool ID",type=integer,JSONPath=`.status.poolId`
+
+// AgentPool is the Schema for the agentpools API
+type AgentPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AgentPoolSpec   `json:"spec,omitempty"`
+	Status AgentPoolStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// AgentPoolList contains a list of AgentPool
+type AgentPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AgentPool `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AgentPool{}, &AgentPoolList{})
+}
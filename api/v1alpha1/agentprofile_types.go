@@ -0,0 +1,113 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AgentProfileSpec defines the desired state of AgentProfile
+type AgentProfileSpec struct {
+	// Template holds the Agent settings shared by the referencing Agents
+	Template AgentTemplate `json:"template"`
+}
+
+// AgentTemplate contains the Agent settings a profile provides, settings
+// that are set on the Agent itself override the profile. The pool, size,
+// rbac and environment are set per Agent as they grant access to Azure
+// DevOps and to namespaces.
+type AgentTemplate struct {
+	// Image of the agents
+	Image string `json:"image,omitempty"`
+	// Resources are the compute resources of the agent
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Proxy configures the proxy settings of the agents, each setting is
+	// inherited separately
+	Proxy ProxyConfig `json:"proxy,omitempty"`
+	// MTU value for networks used by container jobs
+	MTUValue string `json:"mtuValue,omitempty"`
+	// ScaleDown controls how agents are removed when the size is reduced
+	ScaleDown ScaleDownPolicy `json:"scaleDown,omitempty"`
+	// Disruption creates a PodDisruptionBudget for the agents
+	Disruption *DisruptionConfig `json:"disruption,omitempty"`
+	// NetworkPolicy restricts the network traffic of the agents
+	NetworkPolicy *NetworkPolicyConfig `json:"networkPolicy,omitempty"`
+	// SecurityProfile hardens the security context of the agent pods
+	SecurityProfile SecurityProfile `json:"securityProfile,omitempty"`
+	// RuntimeClassName runs the agent pods with a sandboxed container runtime
+	RuntimeClassName *string `json:"runtimeClassName,omitempty"`
+	// Schedules override the size of the Agents while one of them is active
+	Schedules []ScheduleConfig `json:"schedules,omitempty"`
+	// AgentVersion selects the agent software version the pods install
+	AgentVersion *AgentVersionConfig `json:"agentVersion,omitempty"`
+	// Rollout moves a few canary agents to a changed image first
+	Rollout *RolloutConfig `json:"rollout,omitempty"`
+	// Caches shares the tool and package caches between the agents
+	Caches *CachesConfig `json:"caches,omitempty"`
+	// Tools are copied from their images into a directory on the PATH, the
+	// images need /bin/sh and cp
+	//+listType=map
+	//+listMapKey=name
+	Tools []Tool `json:"tools,omitempty"`
+	// Env is added to the environment of the agent container
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// EnvFrom adds the keys of ConfigMaps and Secrets to the environment
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+	// Volumes are added to the agent pods
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+	// VolumeMounts are added to the agent container
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+	// StartupScripts runs the scripts of a ConfigMap before the agent starts
+	StartupScripts *StartupScriptsConfig `json:"startupScripts,omitempty"`
+	// SSH installs the SSH keys the agents authenticate with
+	SSH *SSHConfig `json:"ssh,omitempty"`
+	// ImagePullSecrets are used to pull the images of the agent pods
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// DockerConfig mounts a docker config.json for the container jobs
+	DockerConfig *DockerConfig `json:"dockerConfig,omitempty"`
+}
+
+// AgentProfileStatus defines the observed state of AgentProfile
+type AgentProfileStatus struct {
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+
+// AgentProfile is the Schema for the agentprofiles API
+type AgentProfile struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AgentProfileSpec   `json:"spec,omitempty"`
+	Status AgentProfileStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// AgentProfileList contains a list of AgentProfile
+type AgentProfileList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AgentProfile `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AgentProfile{}, &AgentProfileList{})
+}
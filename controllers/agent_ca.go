@@ -0,0 +1,94 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+const (
+	// caPath is where the operator CA bundle is mounted in the containers
+	caPath = "/opt/azp-ca/ca.crt"
+	// caBundleDir and caBundlePath hold the image bundle combined with the
+	// operator CA bundle
+	caBundleDir  = "/opt/azp-ca-bundle"
+	caBundlePath = caBundleDir + "/ca-certificates.crt"
+)
+
+// combineCABundleScript appends the operator CA bundle to the bundle of
+// the image, the image bundle is not updated as the root filesystem can
+// be read-only and update-ca-certificates needs root
+const combineCABundleScript = `set -e
+for bundle in /etc/ssl/certs/ca-certificates.crt /etc/pki/tls/certs/ca-bundle.crt /etc/ssl/cert.pem; do
+  if [ -f "$bundle" ]; then
+    cat "$bundle" > ` + caBundlePath + `
+    echo >> ` + caBundlePath + `
+    break
+  fi
+done
+cat ` + caPath + ` >> ` + caBundlePath + `
+`
+
+// caBundleForAgent returns the init container that combines the operator
+// CA bundle with the bundle of the image, and the environment pointing
+// OpenSSL, git, curl, python and node to the combined bundle
+func (r *AgentReconciler) caBundleForAgent(m *azdevopsv1alpha1.Agent, securityContext *corev1.SecurityContext) ([]corev1.Container, []corev1.Volume, []corev1.VolumeMount, []corev1.EnvVar) {
+	if r.defaults().CABundle == "" {
+		return nil, nil, nil, nil
+	}
+
+	// the CA bundle is stored in the Agent secret
+	volumes := []corev1.Volume{
+		{
+			Name: "ca",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: m.Name,
+					Items:      []corev1.KeyToPath{{Key: caBundleKey, Path: "ca.crt"}},
+				},
+			},
+		},
+		{
+			Name:         "ca-bundle",
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		},
+	}
+	caMount := corev1.VolumeMount{Name: "ca", MountPath: caPath, SubPath: "ca.crt", ReadOnly: true}
+	bundleMount := corev1.VolumeMount{Name: "ca-bundle", MountPath: caBundleDir}
+
+	initContainers := []corev1.Container{{
+		Name:            "ca-bundle",
+		Image:           m.Spec.Image,
+		Command:         []string{"/bin/sh", "-c", combineCABundleScript},
+		SecurityContext: securityContext,
+		VolumeMounts:    []corev1.VolumeMount{caMount, bundleMount},
+	}}
+
+	bundleMount.ReadOnly = true
+	mounts := []corev1.VolumeMount{caMount, bundleMount}
+	env := []corev1.EnvVar{
+		{Name: "SSL_CERT_FILE", Value: caBundlePath},
+		{Name: "GIT_SSL_CAINFO", Value: caBundlePath},
+		{Name: "CURL_CA_BUNDLE", Value: caBundlePath},
+		{Name: "REQUESTS_CA_BUNDLE", Value: caBundlePath},
+		// node adds the extra certificates to its own bundle
+		{Name: "NODE_EXTRA_CA_CERTS", Value: caPath},
+	}
+	return initContainers, volumes, mounts, env
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+const (
+	// cacheVolumeName is the name of the cache volume in the agent pods
+	cacheVolumeName = "caches"
+	// cacheMountRoot is the directory the caches are mounted in
+	cacheMountRoot = "/caches"
+)
+
+// allCaches are the caches stored on the volume when none are listed
+var allCaches = []azdevopsv1alpha1.Cache{
+	azdevopsv1alpha1.CacheTools,
+	azdevopsv1alpha1.CacheNuGet,
+	azdevopsv1alpha1.CacheNpm,
+	azdevopsv1alpha1.CacheMaven,
+}
+
+// reconcileCaches validates the cache settings and provisions the cache
+// claim. A claim the Agent provisioned is removed when the caches use
+// another volume.
+func (r *AgentReconciler) reconcileCaches(ctx context.Context, m *azdevopsv1alpha1.Agent) (metav1.Condition, error) {
+	c := m.Spec.Caches
+	if c != nil {
+		if err := validateCaches(c); err != nil {
+			return metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionCachesReady,
+				Status:  metav1.ConditionFalse,
+				Reason:  "Invalid",
+				Message: err.Error(),
+			}, nil
+		}
+	}
+
+	if c != nil && c.Storage != nil {
+		if _, err := r.apply(ctx, r.cacheClaimForAgent(m)); err != nil {
+			return metav1.Condition{}, err
+		}
+	} else {
+		found := corev1.PersistentVolumeClaim{}
+		err := r.Get(ctx, types.NamespacedName{Name: cacheClaimNameForAgent(m), Namespace: m.Namespace}, &found)
+		if err != nil && !errors.IsNotFound(err) {
+			return metav1.Condition{}, err
+		} else if err == nil && metav1.IsControlledBy(&found, m) {
+			log.FromContext(ctx).Info("Deleting PersistentVolumeClaim", "PersistentVolumeClaim.Namespace", found.Namespace, "PersistentVolumeClaim.Name", found.Name)
+			if err = r.Delete(ctx, &found); err != nil {
+				return metav1.Condition{}, err
+			}
+		}
+	}
+	if c == nil {
+		return metav1.Condition{}, nil
+	}
+
+	ready := metav1.Condition{
+		Type:   azdevopsv1alpha1.ConditionCachesReady,
+		Status: metav1.ConditionTrue,
+		Reason: "Mounted",
+	}
+	switch {
+	case c.HostPath != "":
+		ready.Message = fmt.Sprintf("caches are stored in %s on the nodes", c.HostPath)
+	case c.Storage != nil:
+		ready.Message = fmt.Sprintf("caches are stored on the provisioned claim %s", cacheClaimNameForAgent(m))
+	default:
+		found := corev1.PersistentVolumeClaim{}
+		err := r.Get(ctx, types.NamespacedName{Name: c.ClaimName, Namespace: m.Namespace}, &found)
+		if err != nil && errors.IsNotFound(err) {
+			// the pods stay pending until the claim is created
+			ready.Status = metav1.ConditionFalse
+			ready.Reason = "ClaimNotFound"
+			ready.Message = fmt.Sprintf("PersistentVolumeClaim %s not found", c.ClaimName)
+			return ready, nil
+		} else if err != nil {
+			return metav1.Condition{}, err
+		}
+		ready.Message = fmt.Sprintf("caches are stored on claim %s", c.ClaimName)
+	}
+	return ready, nil
+}
+
+// validateCaches checks that the caches use exactly one volume
+func validateCaches(c *azdevopsv1alpha1.CachesConfig) error {
+	volumes := 0
+	if c.ClaimName != "" {
+		volumes++
+	}
+	if c.Storage != nil {
+		volumes++
+	}
+	if c.HostPath != "" {
+		volumes++
+	}
+	if volumes != 1 {
+		return fmt.Errorf("caches need exactly one of claimName, storage and hostPath, got %d", volumes)
+	}
+	if c.HostPath != "" && !path.IsAbs(c.HostPath) {
+		return fmt.Errorf("caches hostPath %q is not an absolute path", c.HostPath)
+	}
+	return nil
+}
+
+// cachesForAgent returns the cache volume, the mounts of the caches and
+// the environment variables pointing the tools at them
+func cachesForAgent(m *azdevopsv1alpha1.Agent) ([]corev1.Volume, []corev1.VolumeMount, []corev1.EnvVar) {
+	c := m.Spec.Caches
+	if c == nil || validateCaches(c) != nil {
+		return nil, nil, nil
+	}
+
+	volume := corev1.Volume{Name: cacheVolumeName}
+	switch {
+	case c.HostPath != "":
+		dirOrCreate := corev1.HostPathDirectoryOrCreate
+		volume.HostPath = &corev1.HostPathVolumeSource{Path: c.HostPath, Type: &dirOrCreate}
+	case c.Storage != nil:
+		volume.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{ClaimName: cacheClaimNameForAgent(m)}
+	default:
+		volume.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{ClaimName: c.ClaimName}
+	}
+
+	caches := c.Caches
+	if len(caches) == 0 {
+		caches = allCaches
+	}
+	var mounts []corev1.VolumeMount
+	var env []corev1.EnvVar
+	for _, cache := range caches {
+		dir := path.Join(cacheMountRoot, string(cache))
+		mount := corev1.VolumeMount{Name: cacheVolumeName, MountPath: dir, SubPath: string(cache)}
+		switch cache {
+		case azdevopsv1alpha1.CacheTools:
+			env = append(env, corev1.EnvVar{Name: "AGENT_TOOLSDIRECTORY", Value: dir})
+		case azdevopsv1alpha1.CacheNuGet:
+			env = append(env, corev1.EnvVar{Name: "NUGET_PACKAGES", Value: dir})
+		case azdevopsv1alpha1.CacheNpm:
+			env = append(env, corev1.EnvVar{Name: "npm_config_cache", Value: dir})
+		case azdevopsv1alpha1.CacheMaven:
+			// the pods share one local repository, Maven 3.9 and later lock
+			// the artifacts it writes with file locks on the shared volume
+			env = append(env, corev1.EnvVar{Name: "MAVEN_OPTS", Value: "-Dmaven.repo.local=" + dir +
+				" -Daether.syncContext.named.factory=file-lock -Daether.syncContext.named.nameMapper=file-gav"})
+		default:
+			continue
+		}
+		mounts = append(mounts, mount)
+	}
+	return []corev1.Volume{volume}, mounts, env
+}
+
+// cacheClaimForAgent is the ReadWriteMany claim provisioned for the caches
+func (r *AgentReconciler) cacheClaimForAgent(m *azdevopsv1alpha1.Agent) *corev1.PersistentVolumeClaim {
+	pvc := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:    labelsForAgent(m.Name),
+			Name:      cacheClaimNameForAgent(m),
+			Namespace: m.Namespace,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+			StorageClassName: m.Spec.Caches.StorageClassName,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: *m.Spec.Caches.Storage},
+			},
+		},
+	}
+	// Set Agent instance as the owner and controller
+	ctrl.SetControllerReference(m, &pvc, r.Scheme)
+	return &pvc
+}
+
+// cacheClaimNameForAgent is the name of the provisioned cache claim
+func cacheClaimNameForAgent(m *azdevopsv1alpha1.Agent) string {
+	return m.Name + "-cache"
+}
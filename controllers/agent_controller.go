@@ -21,14 +21,22 @@ import (
 	"reflect"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
 )
@@ -36,16 +44,37 @@ import (
 // AgentReconciler reconciles a Agent object
 type AgentReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	// APIReader reads objects that are not cached, like the namespace of
+	// the Agent when the cache is restricted to the watched namespaces
+	APIReader client.Reader
+	Scheme    *runtime.Scheme
+	// Defaults are the operator wide settings Agents inherit
+	Defaults *AgentDefaults
+	// WatchNamespaces are the namespaces the cache is restricted to, all
+	// namespaces when empty
+	WatchNamespaces []string
+	// ConfigEvents requeues Agents when the operator configuration is reloaded
+	ConfigEvents chan event.GenericEvent
 }
 
 //+kubebuilder:rbac:groups=azdevops.gofound.nl,resources=agents,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=azdevops.gofound.nl,resources=agents/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=azdevops.gofound.nl,resources=agents/finalizers,verbs=update
+//+kubebuilder:rbac:groups=azdevops.gofound.nl,resources=agentprofiles,verbs=get;list;watch
+//+kubebuilder:rbac:groups=azdevops.gofound.nl,resources=agentpools,verbs=get;list;watch
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=networking,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles,verbs=get;list;watch;create;update;patch;delete;bind
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=rolebindings,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles,verbs=bind,resourceNames=view;edit
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;update;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -56,16 +85,28 @@ type AgentReconciler struct {
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.8.3/pkg/reconcile
-func (r *AgentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *AgentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	ctx, span := startReconcileSpan(ctx, "Agent", req.Namespace, req.Name)
 	logger := log.FromContext(ctx)
 
+	// count failed reconciliations by the phase that failed
+	phase := "fetch"
+	defer func() {
+		if err != nil {
+			recordError(req.Namespace, req.Name, phase)
+			span.SetAttributes(attribute.String("azdevops.phase", phase))
+		}
+		endSpan(span, err)
+	}()
+
 	/////////////////////////////////////////////////////////////////////////
 	// Fetch Agent object if it exists
 	agent := azdevopsv1alpha1.Agent{}
-	err := r.Get(ctx, req.NamespacedName, &agent)
+	err = r.Get(ctx, req.NamespacedName, &agent)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			logger.Info("Agent resource not found. Ignoring since object must be deleted")
+			deleteAgentMetrics(req.Namespace, req.Name)
 			// Exit reconciliation as the object has been deleted
 			return ctrl.Result{}, nil
 		}
@@ -74,48 +115,561 @@ func (r *AgentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 		return ctrl.Result{}, err
 	}
 
+	/////////////////////////////////////////////////////////////////////////
+	// Remove resources in other namespaces before the Agent is deleted
+	phase = "finalize"
+	if !agent.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(&agent, agentFinalizer) {
+			if err = r.cleanupRBAC(ctx, &agent); err != nil {
+				logger.Error(err, "Failed to clean up RBAC", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+				return ctrl.Result{}, err
+			}
+			if err = r.cleanupEnvironment(ctx, &agent); err != nil {
+				logger.Error(err, "Failed to clean up Environment", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+				return ctrl.Result{}, err
+			}
+			controllerutil.RemoveFinalizer(&agent, agentFinalizer)
+			if err = r.Update(ctx, &agent); err != nil {
+				logger.Error(err, "Failed to remove finalizer", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+	if (agent.Spec.RBAC != nil || agent.Spec.Environment != nil) && !controllerutil.ContainsFinalizer(&agent, agentFinalizer) {
+		controllerutil.AddFinalizer(&agent, agentFinalizer)
+		if err = r.Update(ctx, &agent); err != nil {
+			logger.Error(err, "Failed to add finalizer", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Leave the owned resources alone while the Agent is paused
+	phase = "paused"
+	if isPaused(&agent) {
+		logger.Info("Agent is paused", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+		err = r.setCondition(ctx, &agent, metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionPaused,
+			Status:  metav1.ConditionTrue,
+			Reason:  "Paused",
+			Message: "reconciliation of the owned resources is paused",
+		})
+		if err != nil {
+			logger.Error(err, "Failed to update Agent status")
+		}
+		// the Agent is reconciled again when it is unpaused
+		return ctrl.Result{}, err
+	}
+	if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionPaused); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Inherit the settings of the referenced AgentProfile
+	phase = "profile"
+	if agent.Spec.ProfileRef != nil {
+		profileResolved, err := r.applyProfile(ctx, &agent)
+		if err != nil {
+			logger.Error(err, "Failed to get AgentProfile", "AgentProfile.Name", agent.Spec.ProfileRef.Name)
+			return ctrl.Result{}, err
+		}
+		if err = r.setCondition(ctx, &agent, profileResolved); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+		if profileResolved.Status == metav1.ConditionFalse {
+			// the AgentProfile watch requeues the Agent once the profile is created
+			logger.Info("AgentProfile not found", "AgentProfile.Name", agent.Spec.ProfileRef.Name)
+			return ctrl.Result{}, nil
+		}
+	} else if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionProfileResolved); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Register the agents in the pool of the referenced AgentPool
+	phase = "pool"
+	if agent.Spec.Pool.AgentPoolRef != nil {
+		poolResolved, err := r.applyAgentPool(ctx, &agent)
+		if err != nil {
+			logger.Error(err, "Failed to get AgentPool", "AgentPool.Namespace", agent.Namespace, "AgentPool.Name", agent.Spec.Pool.AgentPoolRef.Name)
+			return ctrl.Result{}, err
+		}
+		if err = r.setCondition(ctx, &agent, poolResolved); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+		if poolResolved.Status == metav1.ConditionFalse {
+			// the AgentPool watch requeues the Agent once the pool is provisioned
+			logger.Info("AgentPool not available", "AgentPool.Name", agent.Spec.Pool.AgentPoolRef.Name, "Reason", poolResolved.Reason)
+			return ctrl.Result{}, nil
+		}
+	} else if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionPoolResolved); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Inherit the operator wide defaults the Agent does not override
+	r.applyDefaults(&agent)
+
+	/////////////////////////////////////////////////////////////////////////
+	// Override the size with the size of the active schedule
+	phase = "schedule"
+	var nextSchedule time.Duration
+	if len(agent.Spec.Schedules) > 0 {
+		var schedulesValid metav1.Condition
+		activeBefore := agent.Status.ActiveSchedule
+		nextSchedule, schedulesValid = applySchedules(&agent, time.Now())
+		if agent.Status.ActiveSchedule != activeBefore {
+			logger.Info("Active schedule changed", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name, "Schedule", agent.Status.ActiveSchedule, "Size", agent.Spec.Size)
+			if err = r.updateStatus(ctx, &agent); err != nil {
+				logger.Error(err, "Failed to update Agent status")
+				return ctrl.Result{}, err
+			}
+		}
+		if err = r.setCondition(ctx, &agent, schedulesValid); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+		if schedulesValid.Status == metav1.ConditionFalse {
+			logger.Info("Invalid schedule", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name, "Message", schedulesValid.Message)
+			return ctrl.Result{}, nil
+		}
+	} else {
+		if agent.Status.ActiveSchedule != "" {
+			agent.Status.ActiveSchedule = ""
+			if err = r.updateStatus(ctx, &agent); err != nil {
+				logger.Error(err, "Failed to update Agent status")
+				return ctrl.Result{}, err
+			}
+		}
+		if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionSchedulesValid); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Select the agent software version, the recorded version is kept
+	// while Azure DevOps is unavailable
+	phase = "agentversion"
+	if agent.Spec.AgentVersion != nil {
+		resolved, err := r.reconcileAgentVersion(ctx, &agent)
+		if err != nil {
+			logger.Error(err, "Failed to select agent version", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+			resolved = metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionAgentVersionResolved,
+				Status:  metav1.ConditionFalse,
+				Reason:  "ResolveFailed",
+				Message: err.Error(),
+			}
+		}
+		if statusErr := r.setCondition(ctx, &agent, resolved); statusErr != nil {
+			logger.Error(statusErr, "Failed to update Agent status")
+			return ctrl.Result{}, statusErr
+		}
+		if err != nil && agent.Status.AgentVersion == nil {
+			return ctrl.Result{}, err
+		}
+	} else {
+		if agent.Status.AgentVersion != nil {
+			agent.Status.AgentVersion = nil
+			if err = r.updateStatus(ctx, &agent); err != nil {
+				logger.Error(err, "Failed to update Agent status")
+				return ctrl.Result{}, err
+			}
+		}
+		if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionAgentVersionResolved); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure the image is pulled from an allowed registry
+	phase = "image"
+	imageAllowed := r.checkImage(&agent)
+	if err = r.setCondition(ctx, &agent, imageAllowed); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+	if imageAllowed.Status == metav1.ConditionFalse {
+		logger.Info("Image not allowed by the operator configuration", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name, "Image", agent.Spec.Image)
+		return ctrl.Result{}, nil
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure ServiceAccount, Roles and RoleBindings match the rbac settings
+	phase = "rbac"
+	if agent.Spec.RBAC != nil {
+		rbacAllowed := r.checkRBAC(&agent)
+		if err = r.setCondition(ctx, &agent, rbacAllowed); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+		if rbacAllowed.Status == metav1.ConditionFalse {
+			logger.Info("RBAC not allowed by the operator configuration", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name, "Message", rbacAllowed.Message)
+			return ctrl.Result{}, nil
+		}
+	} else if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionRBACAllowed); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+	if err = r.reconcileRBAC(ctx, &agent); err != nil {
+		logger.Error(err, "Failed to reconcile RBAC", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+		return ctrl.Result{}, err
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure the target namespace is registered in the Azure DevOps Environment
+	phase = "environment"
+	if agent.Spec.Environment != nil {
+		registered, err := r.reconcileEnvironment(ctx, &agent)
+		if err != nil {
+			logger.Error(err, "Failed to register Environment", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+			registered = metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionEnvironmentRegistered,
+				Status:  metav1.ConditionFalse,
+				Reason:  "RegistrationFailed",
+				Message: err.Error(),
+			}
+		}
+		if statusErr := r.setCondition(ctx, &agent, registered); statusErr != nil {
+			logger.Error(statusErr, "Failed to update Agent status")
+			return ctrl.Result{}, statusErr
+		}
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	} else {
+		if agent.Status.Environment != nil {
+			if err = r.cleanupEnvironment(ctx, &agent); err != nil {
+				logger.Error(err, "Failed to clean up Environment", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+				return ctrl.Result{}, err
+			}
+		}
+		if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionEnvironmentRegistered); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure the volume of the shared caches
+	phase = "caches"
+	cachesReady, err := r.reconcileCaches(ctx, &agent)
+	if err != nil {
+		logger.Error(err, "Failed to reconcile caches", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+		return ctrl.Result{}, err
+	}
+	if agent.Spec.Caches != nil {
+		if err = r.setCondition(ctx, &agent, cachesReady); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+		if cachesReady.Reason == "Invalid" {
+			logger.Info("Invalid caches", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name, "Message", cachesReady.Message)
+			return ctrl.Result{}, nil
+		}
+	} else if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionCachesReady); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Read the credentials of an authenticated proxy
+	phase = "proxy"
+	proxyCredentials, proxyResolved, err := r.proxyCredentials(ctx, &agent)
+	if err != nil {
+		logger.Error(err, "Failed to read proxy credentials", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+		return ctrl.Result{}, err
+	}
+	if agent.Spec.Proxy.CredentialsSecretRef != nil {
+		if err = r.setCondition(ctx, &agent, proxyResolved); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+		if proxyResolved.Status == metav1.ConditionFalse {
+			// the agents can not reach Azure DevOps, check again when the Secret changes
+			logger.Info("Proxy credentials not found", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name, "Message", proxyResolved.Message)
+			return ctrl.Result{}, nil
+		}
+	} else if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionProxyCredentialsResolved); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure the SSH keys exist
+	phase = "ssh"
+	if agent.Spec.SSH != nil {
+		sshResolved, err := r.checkSSH(ctx, &agent)
+		if err != nil {
+			logger.Error(err, "Failed to check SSH keys", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+			return ctrl.Result{}, err
+		}
+		if err = r.setCondition(ctx, &agent, sshResolved); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+		if sshResolved.Status == metav1.ConditionFalse {
+			// pods would not start, check again later as the ConfigMaps are not watched
+			logger.Info("SSH keys not found", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name, "Message", sshResolved.Message)
+			return ctrl.Result{RequeueAfter: time.Minute}, nil
+		}
+	} else if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionSSHKeysResolved); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure the docker config.json exists and refresh its registry tokens
+	phase = "dockerconfig"
+	if agent.Spec.DockerConfig != nil {
+		dockerConfig, err := r.reconcileDockerConfig(ctx, &agent, time.Now())
+		if err != nil {
+			logger.Error(err, "Failed to refresh registry tokens", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+			dockerConfig = metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionDockerConfigReady,
+				Status:  metav1.ConditionFalse,
+				Reason:  "RefreshFailed",
+				Message: err.Error(),
+			}
+		}
+		if statusErr := r.setCondition(ctx, &agent, dockerConfig); statusErr != nil {
+			logger.Error(statusErr, "Failed to update Agent status")
+			return ctrl.Result{}, statusErr
+		}
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if dockerConfig.Status == metav1.ConditionFalse {
+			logger.Info("Docker config not ready", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name, "Message", dockerConfig.Message)
+			return ctrl.Result{RequeueAfter: time.Minute}, nil
+		}
+	} else {
+		if _, err = r.reconcileDockerConfig(ctx, &agent, time.Now()); err != nil {
+			logger.Error(err, "Failed to remove docker config", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+			return ctrl.Result{}, err
+		}
+		if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionDockerConfigReady); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure the security profile is allowed in the namespace
+	phase = "podsecurity"
+	podSecurity, err := r.checkPodSecurity(ctx, &agent)
+	if err != nil {
+		logger.Error(err, "Failed to check pod security", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+		return ctrl.Result{}, err
+	}
+	if err = r.setCondition(ctx, &agent, podSecurity); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+	if podSecurity.Status == metav1.ConditionFalse {
+		// pods would be rejected, check again when the namespace is relabeled
+		logger.Info("Security profile not allowed in namespace", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
 	/////////////////////////////////////////////////////////////////////////
 	// Fetch Deployment object if it exists
+	phase = "deployment"
 	found := appsv1.Deployment{}
 	err = r.Get(ctx, types.NamespacedName{Name: agent.Name, Namespace: agent.Namespace}, &found)
-	if err != nil && errors.IsNotFound(err) {
-		dep := r.deploymentForAgent(&agent)
-		logger.Info("Creating a new Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
-		err = r.Create(ctx, dep)
-		if err != nil {
-			logger.Error(err, "Failed to create new Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "Failed to get Deployment")
+		return ctrl.Result{}, err
+	}
+	exists := err == nil
+
+	/////////////////////////////////////////////////////////////////////////
+	// Roll a changed image out to canary agents first, the other agents
+	// keep the stable image
+	phase = "rollout"
+	var rollout *azdevopsv1alpha1.RolloutStatus
+	if agent.Spec.Rollout != nil {
+		var current *appsv1.Deployment
+		if exists {
+			current = &found
+		}
+		if rollout, err = r.reconcileRollout(ctx, &agent, current, time.Now()); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+		agent.Spec.Image = rollout.StableImage
+	} else if agent.Status.Rollout != nil {
+		agent.Status.Rollout = nil
+		if err = r.updateStatus(ctx, &agent); err != nil {
+			logger.Error(err, "Failed to update Agent status")
 			return ctrl.Result{}, err
 		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Apply the Deployment, the replicas are left to other managers, like a
+	// HorizontalPodAutoscaler, once they took them over
+	phase = "deployment"
+	scaleReplicas := !exists || ownsField(&found, "spec", "replicas")
+	dep := r.deploymentForAgent(&agent)
+	if !scaleReplicas {
+		dep.Spec.Replicas = nil
+	} else if exists {
+		// the replicas are changed in the scale step
+		dep.Spec.Replicas = found.Spec.Replicas
+	}
+	op, err := r.apply(ctx, dep)
+	if err != nil {
+		logger.Error(err, "Failed to apply Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
+		return ctrl.Result{}, err
+	}
+	if op != "" {
+		recordWrite(agent.Namespace, agent.Name, "Deployment", op)
+	}
+	if !exists {
 		// Deployment created successfully - return and requeue
 		return ctrl.Result{RequeueAfter: time.Minute}, nil
-	} else if err != nil {
-		logger.Error(err, "Failed to get Deployment")
+	}
+	found = *dep
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure the canary Deployment runs while a rollout progresses
+	phase = "rollout"
+	if err = r.reconcileCanary(ctx, &agent, rollout); err != nil {
+		logger.Error(err, "Failed to reconcile canary Deployment", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
 		return ctrl.Result{}, err
 	}
 
 	/////////////////////////////////////////////////////////////////////////
-	// Ensure Secret is created and up-to-date
-	foundSec := corev1.Secret{}
-	err = r.Get(ctx, types.NamespacedName{Name: agent.Name, Namespace: agent.Namespace}, &foundSec)
-	if err != nil && errors.IsNotFound(err) {
-		sec := r.secretForAgent(&agent)
-		logger.Info("Creating a new Secret", "Secret.Namespace", sec.Namespace, "Secret.Name", sec.Name)
-		err = r.Create(ctx, sec)
+	// Export the agent metrics, failures do not stop the reconciliation
+	if err := r.recordAgentMetrics(ctx, &agent, &found); err != nil {
+		logger.Error(err, "Failed to collect agent metrics", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+		recordError(agent.Namespace, agent.Name, "metrics")
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Disable the agents in Azure DevOps during maintenance, enable them
+	// again afterwards
+	phase = "maintenance"
+	if inMaintenance(&agent) {
+		maintenance, err := r.startMaintenance(ctx, &agent)
 		if err != nil {
-			logger.Error(err, "Failed to create new Secret", "Secret.Namespace", sec.Namespace, "Secret.Name", sec.Name)
+			logger.Error(err, "Failed to disable agents for maintenance", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+			maintenance = metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionMaintenance,
+				Status:  metav1.ConditionFalse,
+				Reason:  "DisableFailed",
+				Message: err.Error(),
+			}
+		}
+		if statusErr := r.setCondition(ctx, &agent, maintenance); statusErr != nil {
+			logger.Error(statusErr, "Failed to update Agent status")
+			return ctrl.Result{}, statusErr
+		}
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	} else {
+		if err = r.endMaintenance(ctx, &agent); err != nil {
+			logger.Error(err, "Failed to enable agents after maintenance", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
 			return ctrl.Result{}, err
 		}
-	} else if err != nil {
-		logger.Error(err, "Failed to get Secret")
+		if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionMaintenance); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Apply the Secret
+	phase = "secret"
+	sec := r.secretForAgent(&agent, proxyCredentials)
+	op, err = r.apply(ctx, sec)
+	if err != nil {
+		logger.Error(err, "Failed to apply Secret", "Secret.Namespace", sec.Namespace, "Secret.Name", sec.Name)
 		return ctrl.Result{}, err
-	} else if err == nil && !errors.IsNotFound(err) {
-		// compare agent data with found secret data
-		if !reflect.DeepEqual(r.secretForAgent(&agent).StringData, foundSec.StringData) {
-			logger.Info("Update existing Secret", "Secret.Namespace", foundSec.Namespace, "Secret.Name", foundSec.Name)
-			// update existing secret
-			r.Update(ctx, r.secretForAgent(&agent))
+	}
+	if op != "" {
+		recordWrite(agent.Namespace, agent.Name, "Secret", op)
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure PodDisruptionBudget matches the disruption settings
+	phase = "disruptionbudget"
+	if agent.Spec.Disruption != nil {
+		pdb := r.podDisruptionBudgetForAgent(&agent)
+		if _, err = r.apply(ctx, pdb); err != nil {
+			logger.Error(err, "Failed to apply PodDisruptionBudget", "PodDisruptionBudget.Namespace", pdb.Namespace, "PodDisruptionBudget.Name", pdb.Name)
+			return ctrl.Result{}, err
+		}
+	} else {
+		// disruption settings are removed, remove the owned budget as well
+		foundPdb := policyv1beta1.PodDisruptionBudget{}
+		err = r.Get(ctx, types.NamespacedName{Name: agent.Name, Namespace: agent.Namespace}, &foundPdb)
+		if err != nil && !errors.IsNotFound(err) {
+			logger.Error(err, "Failed to get PodDisruptionBudget")
+			return ctrl.Result{}, err
+		} else if err == nil && metav1.IsControlledBy(&foundPdb, &agent) {
+			logger.Info("Deleting PodDisruptionBudget", "PodDisruptionBudget.Namespace", foundPdb.Namespace, "PodDisruptionBudget.Name", foundPdb.Name)
+			err = r.Delete(ctx, &foundPdb)
 			if err != nil {
-				logger.Error(err, "Failed to update Secret", "Secret.Namespace", agent.Namespace, "Secret.Name", agent.Name)
+				logger.Error(err, "Failed to delete PodDisruptionBudget", "PodDisruptionBudget.Namespace", foundPdb.Namespace, "PodDisruptionBudget.Name", foundPdb.Name)
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure NetworkPolicy matches the network policy settings
+	phase = "networkpolicy"
+	if agent.Spec.NetworkPolicy != nil {
+		valid := metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionNetworkPolicyValid,
+			Status:  metav1.ConditionTrue,
+			Reason:  "Applied",
+			Message: "the NetworkPolicy is applied",
+		}
+		if err := validateNetworkPolicy(agent.Spec.NetworkPolicy); err != nil {
+			// the applied policy is kept until the settings are fixed
+			logger.Info("Invalid network policy", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name, "Message", err.Error())
+			valid.Status = metav1.ConditionFalse
+			valid.Reason = "Invalid"
+			valid.Message = err.Error()
+		} else {
+			np := r.networkPolicyForAgent(&agent)
+			if _, err = r.apply(ctx, np); err != nil {
+				logger.Error(err, "Failed to apply NetworkPolicy", "NetworkPolicy.Namespace", np.Namespace, "NetworkPolicy.Name", np.Name)
+				return ctrl.Result{}, err
+			}
+		}
+		if err = r.setCondition(ctx, &agent, valid); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+	} else {
+		if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionNetworkPolicyValid); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+		// network policy settings are removed, remove the owned policy as well
+		foundNp := networkingv1.NetworkPolicy{}
+		err = r.Get(ctx, types.NamespacedName{Name: agent.Name, Namespace: agent.Namespace}, &foundNp)
+		if err != nil && !errors.IsNotFound(err) {
+			logger.Error(err, "Failed to get NetworkPolicy")
+			return ctrl.Result{}, err
+		} else if err == nil && metav1.IsControlledBy(&foundNp, &agent) {
+			logger.Info("Deleting NetworkPolicy", "NetworkPolicy.Namespace", foundNp.Namespace, "NetworkPolicy.Name", foundNp.Name)
+			err = r.Delete(ctx, &foundNp)
+			if err != nil {
+				logger.Error(err, "Failed to delete NetworkPolicy", "NetworkPolicy.Namespace", foundNp.Namespace, "NetworkPolicy.Name", foundNp.Name)
 				return ctrl.Result{}, err
 			}
 		}
@@ -123,22 +677,55 @@ func (r *AgentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 
 	/////////////////////////////////////////////////////////////////////////
 	// Ensure deployment replicas is the same as the Agent size
-	size := agent.Spec.Size
-	if *found.Spec.Replicas != size {
-		found.Spec.Replicas = &size
-		err = r.Update(ctx, &found)
-		if err != nil {
-			logger.Error(err, "Failed to update Deployment", "Deployment.Namespace", found.Namespace, "Deployment.Name", found.Name)
+	phase = "scale"
+	if len(agent.Spec.Schedules) > 0 {
+		if err = r.setCondition(ctx, &agent, schedulesApplied(&agent, scaleReplicas)); err != nil {
+			logger.Error(err, "Failed to update Agent status")
 			return ctrl.Result{}, err
 		}
+	} else if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionSchedulesApplied); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+	size := agent.Spec.Size
+	if scaleReplicas && *found.Spec.Replicas != size {
+		replicas := size
+		if *found.Spec.Replicas > size {
+			// Only remove agents that are not running a job
+			replicas, err = r.scaleDownAgents(ctx, &agent, *found.Spec.Replicas, *found.Spec.Replicas-size)
+			if err != nil {
+				logger.Error(err, "Failed to select idle agents for removal", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+				return ctrl.Result{}, err
+			}
+		}
+		if *found.Spec.Replicas != replicas {
+			dep := r.deploymentForAgent(&agent)
+			dep.Spec.Replicas = &replicas
+			if _, err = r.apply(ctx, dep); err != nil {
+				logger.Error(err, "Failed to apply Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
+				return ctrl.Result{}, err
+			}
+			recordWrite(agent.Namespace, agent.Name, "Deployment", "update")
+		}
 		// Ask to requeue after 1 minute in order to give enough time for the
 		// pods be created on the cluster side and the operand be able
 		// to do the next update step accurately.
 		return ctrl.Result{RequeueAfter: time.Minute}, nil
 	}
 
+	/////////////////////////////////////////////////////////////////////////
+	// Enable agents that were disabled for a scale down that is not needed anymore
+	phase = "release"
+	if found.Status.Replicas == size && !inMaintenance(&agent) {
+		if err = r.releaseAgents(ctx, &agent); err != nil {
+			logger.Error(err, "Failed to release agents", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+			return ctrl.Result{}, err
+		}
+	}
+
 	/////////////////////////////////////////////////////////////////////////
 	// Fetch pods to get their names
+	phase = "status"
 	podList := &corev1.PodList{}
 	listOpts := []client.ListOption{
 		client.InNamespace(agent.Namespace),
@@ -149,12 +736,41 @@ func (r *AgentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 		return ctrl.Result{}, err
 	}
 
+	/////////////////////////////////////////////////////////////////////////
+	// Report startup scripts that are missing or failed in the pods
+	if agent.Spec.StartupScripts != nil {
+		scripts, err := r.checkStartupScripts(ctx, &agent, podList.Items)
+		if err != nil {
+			logger.Error(err, "Failed to check startup scripts", "Agent.Namespace", agent.Namespace, "Agent.Name", agent.Name)
+			return ctrl.Result{}, err
+		}
+		if err = r.setCondition(ctx, &agent, scripts); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+	} else if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionStartupScriptsSucceeded); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Report tools that could not be copied from their images
+	if len(agent.Spec.Tools) > 0 {
+		if err = r.setCondition(ctx, &agent, checkTools(&agent, podList.Items)); err != nil {
+			logger.Error(err, "Failed to update Agent status")
+			return ctrl.Result{}, err
+		}
+	} else if err = r.removeCondition(ctx, &agent, azdevopsv1alpha1.ConditionToolsInstalled); err != nil {
+		logger.Error(err, "Failed to update Agent status")
+		return ctrl.Result{}, err
+	}
+
 	/////////////////////////////////////////////////////////////////////////
 	// Update Agent status with pod names
 	podNames := getPodNames(podList.Items)
 	if !reflect.DeepEqual(podNames, agent.Status.Agents) {
 		agent.Status.Agents = podNames
-		err := r.Status().Update(ctx, &agent)
+		err := r.updateStatus(ctx, &agent)
 		if err != nil {
 			logger.Error(err, "Failed to update Agent status")
 			return ctrl.Result{}, err
@@ -162,14 +778,45 @@ func (r *AgentReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 		return ctrl.Result{RequeueAfter: time.Minute}, nil
 	}
 
-	return ctrl.Result{}, nil
+	// Requeue to refresh the agent metrics, or earlier when the next
+	// schedule window opens or closes
+	requeue := metricsInterval
+	if nextSchedule > 0 && nextSchedule < requeue {
+		requeue = nextSchedule
+	}
+	return ctrl.Result{RequeueAfter: requeue}, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *AgentReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &azdevopsv1alpha1.Agent{}, profileRefIndex, profileRefName); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &azdevopsv1alpha1.Agent{}, agentPoolRefIndex, agentPoolRefName); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &azdevopsv1alpha1.Agent{}, proxySecretRefIndex, proxySecretRefName); err != nil {
+		return err
+	}
+
+	bldr := ctrl.NewControllerManagedBy(mgr).
 		For(&azdevopsv1alpha1.Agent{}).
 		Owns(&appsv1.Deployment{}).
 		Owns(&corev1.Secret{}).
-		Complete(r)
+		Owns(&policyv1beta1.PodDisruptionBudget{}).
+		Owns(&networkingv1.NetworkPolicy{}).
+		Owns(&corev1.ServiceAccount{}).
+		Owns(&corev1.PersistentVolumeClaim{}).
+		Watches(&source.Kind{Type: &azdevopsv1alpha1.AgentPool{}}, handler.EnqueueRequestsFromMapFunc(r.agentsForAgentPool)).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.agentsForProxySecret))
+	// a cache restricted to namespaces can not watch the cluster scoped
+	// AgentProfiles, profile changes are then picked up by the periodic
+	// reconciliation of the Agents
+	if len(r.WatchNamespaces) == 0 {
+		bldr = bldr.Watches(&source.Kind{Type: &azdevopsv1alpha1.AgentProfile{}}, handler.EnqueueRequestsFromMapFunc(r.agentsForProfile))
+	}
+	if r.ConfigEvents != nil {
+		bldr = bldr.Watches(&source.Channel{Source: r.ConfigEvents}, &handler.EnqueueRequestForObject{})
+	}
+	return bldr.Complete(r)
 }
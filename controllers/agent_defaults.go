@@ -0,0 +1,246 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	configv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/config/v1alpha1"
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+const (
+	// defaultAgentImage is used when neither the Agent nor the operator
+	// configuration provide an image
+	defaultAgentImage = "bartvanbenthem/agent:latest"
+	// caBundleKey is the Secret key holding the operator CA bundle
+	caBundleKey = "CA_BUNDLE"
+)
+
+// AgentDefaults holds the operator wide defaults Agents inherit, it is safe
+// for concurrent use as the defaults are reloaded while the operator runs.
+type AgentDefaults struct {
+	mu       sync.RWMutex
+	defaults configv1alpha1.AgentDefaults
+}
+
+// NewAgentDefaults returns AgentDefaults holding defaults
+func NewAgentDefaults(defaults configv1alpha1.AgentDefaults) *AgentDefaults {
+	return &AgentDefaults{defaults: defaults}
+}
+
+// Get returns a copy of the current defaults
+func (d *AgentDefaults) Get() configv1alpha1.AgentDefaults {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return *d.defaults.DeepCopy()
+}
+
+// Set replaces the current defaults
+func (d *AgentDefaults) Set(defaults configv1alpha1.AgentDefaults) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.defaults = defaults
+}
+
+// defaults returns the operator wide Agent defaults
+func (r *AgentReconciler) defaults() configv1alpha1.AgentDefaults {
+	if r.Defaults == nil {
+		return configv1alpha1.AgentDefaults{}
+	}
+	return r.Defaults.Get()
+}
+
+// applyDefaults fills the settings the Agent does not override with the
+// operator wide defaults, the Agent is only changed in memory
+func (r *AgentReconciler) applyDefaults(m *azdevopsv1alpha1.Agent) {
+	d := r.defaults()
+
+	if m.Spec.Image == "" {
+		m.Spec.Image = d.Image
+	}
+	if m.Spec.Image == "" {
+		m.Spec.Image = defaultAgentImage
+	}
+	if m.Spec.Resources == nil && (len(d.Resources.Limits) > 0 || len(d.Resources.Requests) > 0) {
+		m.Spec.Resources = d.Resources.DeepCopy()
+	}
+	if m.Spec.Proxy.HTTPProxy == "" {
+		m.Spec.Proxy.HTTPProxy = d.Proxy.HTTPProxy
+	}
+	if m.Spec.Proxy.HTTPSProxy == "" {
+		m.Spec.Proxy.HTTPSProxy = d.Proxy.HTTPSProxy
+	}
+	if m.Spec.Proxy.FTPProxy == "" {
+		m.Spec.Proxy.FTPProxy = d.Proxy.FTPProxy
+	}
+	if m.Spec.Proxy.NoProxy == "" {
+		m.Spec.Proxy.NoProxy = d.Proxy.NoProxy
+	}
+	if m.Spec.Proxy.CredentialsSecretRef == nil {
+		m.Spec.Proxy.CredentialsSecretRef = d.Proxy.CredentialsSecretRef
+	}
+	if m.Spec.SecurityProfile == "" {
+		m.Spec.SecurityProfile = d.SecurityProfile
+	}
+}
+
+// checkImage verifies the Agent image, the tool images and the ssh-agent
+// image are pulled from an allowed registry
+func (r *AgentReconciler) checkImage(m *azdevopsv1alpha1.Agent) metav1.Condition {
+	allowed := r.defaults().AllowedRegistries
+	if len(allowed) == 0 {
+		return metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionImageAllowed,
+			Status:  metav1.ConditionTrue,
+			Reason:  "NoRestrictions",
+			Message: "the operator allows images from all registries",
+		}
+	}
+	images := []string{m.Spec.Image}
+	for _, tool := range m.Spec.Tools {
+		images = append(images, tool.Image)
+	}
+	if m.Spec.SSH != nil && m.Spec.SSH.Agent != nil && m.Spec.SSH.Agent.Image != "" {
+		images = append(images, m.Spec.SSH.Agent.Image)
+	}
+	for _, image := range images {
+		if !imageAllowed(image, allowed) {
+			return metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionImageAllowed,
+				Status:  metav1.ConditionFalse,
+				Reason:  "RegistryNotAllowed",
+				Message: fmt.Sprintf("image %s is not pulled from one of the allowed registries %s", image, strings.Join(allowed, ", ")),
+			}
+		}
+	}
+	message := fmt.Sprintf("image %s is pulled from an allowed registry", m.Spec.Image)
+	if len(images) > 1 {
+		message = fmt.Sprintf("image %s and the tool and sidecar images are pulled from an allowed registry", m.Spec.Image)
+	}
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionImageAllowed,
+		Status:  metav1.ConditionTrue,
+		Reason:  "RegistryAllowed",
+		Message: message,
+	}
+}
+
+// imageAllowed returns true if image starts with one of the allowed
+// registries or repository prefixes. Images without a registry are
+// expanded to docker.io like the container runtime does.
+func imageAllowed(image string, allowed []string) bool {
+	normalized := image
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 {
+		normalized = "docker.io/library/" + image
+	} else if !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost" {
+		normalized = "docker.io/" + image
+	}
+	for _, prefix := range allowed {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if strings.HasPrefix(normalized, prefix+"/") || strings.HasPrefix(image, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigReloader reloads the Agent defaults when the operator configuration
+// file changes and requeues all Agents so they pick up the new defaults.
+type ConfigReloader struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Path     string
+	Interval time.Duration
+	Defaults *AgentDefaults
+	// Events receives an event for every Agent after a reload
+	Events chan event.GenericEvent
+}
+
+// Start polls the configuration file until ctx is done, a ConfigMap mounted
+// file is replaced through a symlink so the content is compared
+func (c *ConfigReloader) Start(ctx context.Context) error {
+	logger := ctrl.Log.WithName("config-reloader")
+
+	last, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		content, err := ioutil.ReadFile(c.Path)
+		if err != nil {
+			logger.Error(err, "Failed to read operator configuration", "path", c.Path)
+			continue
+		}
+		if bytes.Equal(content, last) {
+			continue
+		}
+		last = content
+
+		config := configv1alpha1.OperatorConfig{}
+		codecs := serializer.NewCodecFactory(c.Scheme)
+		if err := runtime.DecodeInto(codecs.UniversalDecoder(), content, &config); err != nil {
+			logger.Error(err, "Failed to decode operator configuration, keeping current defaults", "path", c.Path)
+			continue
+		}
+		c.Defaults.Set(config.AgentDefaults)
+		logger.Info("Reloaded Agent defaults", "path", c.Path)
+
+		agents := &azdevopsv1alpha1.AgentList{}
+		if err := c.List(ctx, agents); err != nil {
+			logger.Error(err, "Failed to list Agents")
+			continue
+		}
+		for i := range agents.Items {
+			select {
+			case c.Events <- event.GenericEvent{Object: &agents.Items[i]}:
+			default:
+				// the controller is not running on this replica, it
+				// reconciles all Agents when it starts
+			}
+		}
+	}
+}
+
+// NeedLeaderElection returns false so every replica keeps its defaults up
+// to date and a newly elected leader does not start with stale defaults
+func (c *ConfigReloader) NeedLeaderElection() bool {
+	return false
+}
@@ -0,0 +1,379 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/azdevops-agent-operator/pkg/azdevops"
+)
+
+// reconcileEnvironment registers the target namespace as Kubernetes resource
+// in the Azure DevOps Environment. Azure DevOps deploys to the namespace with
+// the token of a generated ServiceAccount through a service endpoint.
+func (r *AgentReconciler) reconcileEnvironment(ctx context.Context, m *azdevopsv1alpha1.Agent) (metav1.Condition, error) {
+	logger := log.FromContext(ctx)
+	env := m.Spec.Environment
+	namespace := environmentNamespaceForAgent(m)
+
+	// the generated ServiceAccount is granted the ClusterRole, so the
+	// namespace and ClusterRole must be allowed like rbac targets
+	if reason, message := r.checkTarget(m, namespace, []string{env.ClusterRole}); reason != "" {
+		return metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionEnvironmentRegistered,
+			Status:  metav1.ConditionFalse,
+			Reason:  reason,
+			Message: message,
+		}, nil
+	}
+
+	// deregister the namespace when the agent targets another namespace,
+	// project or Environment
+	if st := m.Status.Environment; st != nil && (st.Namespace != namespace || st.Project != env.Project ||
+		(st.Environment != "" && st.Environment != env.Name)) {
+		if err := r.cleanupEnvironment(ctx, m); err != nil {
+			return metav1.Condition{}, err
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure ServiceAccount, RoleBinding and token Secret in the namespace
+	if _, err := r.apply(ctx, r.environmentServiceAccountForAgent(m)); err != nil {
+		return metav1.Condition{}, err
+	}
+	if err := r.applyRoleBinding(ctx, r.environmentRoleBindingForAgent(m)); err != nil {
+		return metav1.Condition{}, err
+	}
+	token := r.environmentTokenForAgent(m)
+	if _, err := r.apply(ctx, token); err != nil {
+		return metav1.Condition{}, err
+	}
+	if len(token.Data[corev1.ServiceAccountTokenKey]) == 0 {
+		return metav1.Condition{}, fmt.Errorf("token of ServiceAccount %s/%s is not issued yet", namespace, environmentNameForAgent(m))
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure the Environment exists in the Azure DevOps project
+	ado := azdevops.NewClient(m.Spec.Pool.URL, m.Spec.Pool.Token)
+	st := m.Status.Environment.DeepCopy()
+	if st == nil {
+		project, err := ado.GetProject(ctx, env.Project)
+		if err != nil {
+			return metav1.Condition{}, err
+		}
+		st = &azdevopsv1alpha1.EnvironmentStatus{Project: env.Project, ProjectID: project.ID, Namespace: namespace}
+	}
+	environment, err := ado.GetEnvironmentByName(ctx, env.Project, env.Name)
+	if err != nil && azdevops.IsNotFound(err) {
+		logger.Info("Creating a new Environment in Azure DevOps", "Project", env.Project, "Environment", env.Name)
+		environment, err = ado.CreateEnvironment(ctx, env.Project, &azdevops.Environment{
+			Name:        env.Name,
+			Description: "Managed by the azdevops-agent-operator",
+		})
+	}
+	if err != nil {
+		return metav1.Condition{}, err
+	}
+	if st.EnvironmentID != environment.ID {
+		// the resource belongs to the Environment that was replaced
+		if err = r.deregisterNamespace(ctx, ado, st); err != nil {
+			return metav1.Condition{}, err
+		}
+		st.EnvironmentID = environment.ID
+	}
+	st.Environment = env.Name
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure the service endpoint holds the current cluster URL and token
+	endpoint := serviceEndpointForAgent(m, st, token)
+	hash := serviceEndpointHash(m, token)
+	if st.ServiceEndpointID != "" && st.ServiceEndpointHash != hash {
+		logger.Info("Updating service endpoint in Azure DevOps", "Project", env.Project, "ServiceEndpoint.ID", st.ServiceEndpointID)
+		endpoint.ID = st.ServiceEndpointID
+		_, err = ado.UpdateServiceEndpoint(ctx, endpoint)
+		if err != nil && azdevops.IsNotFound(err) {
+			// the endpoint was deleted in the portal, the namespace is
+			// registered again with a new endpoint
+			if err = r.deregisterNamespace(ctx, ado, st); err != nil {
+				return metav1.Condition{}, err
+			}
+			st.ServiceEndpointID = ""
+		} else if err != nil {
+			return metav1.Condition{}, err
+		} else {
+			st.ServiceEndpointHash = hash
+		}
+		endpoint.ID = ""
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Check the namespace is still registered
+	if st.ResourceID != 0 {
+		_, err = ado.GetKubernetesResource(ctx, env.Project, st.EnvironmentID, st.ResourceID)
+		if err != nil && azdevops.IsNotFound(err) {
+			logger.Info("Kubernetes resource removed from Environment", "Environment", env.Name, "Namespace", namespace)
+			st.ResourceID = 0
+		} else if err != nil {
+			return metav1.Condition{}, err
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Register the namespace through a service endpoint holding the token
+	if st.ResourceID == 0 {
+		if st.ServiceEndpointID == "" {
+			logger.Info("Creating a new service endpoint in Azure DevOps", "Project", env.Project, "Namespace", namespace)
+			created, err := ado.CreateServiceEndpoint(ctx, endpoint)
+			if err != nil {
+				return metav1.Condition{}, err
+			}
+			st.ServiceEndpointID = created.ID
+			st.ServiceEndpointHash = hash
+			// record the endpoint before registering so it is never leaked
+			if err = r.setEnvironmentStatus(ctx, m, st); err != nil {
+				return metav1.Condition{}, err
+			}
+		}
+		logger.Info("Registering namespace in Environment", "Environment", env.Name, "Namespace", namespace)
+		resource, err := ado.CreateKubernetesResource(ctx, env.Project, st.EnvironmentID, &azdevops.KubernetesResource{
+			Name:              namespace,
+			Namespace:         namespace,
+			ClusterName:       env.ClusterName,
+			ServiceEndpointID: st.ServiceEndpointID,
+		})
+		if err != nil {
+			return metav1.Condition{}, err
+		}
+		st.ResourceID = resource.ID
+	}
+	if err = r.setEnvironmentStatus(ctx, m, st); err != nil {
+		return metav1.Condition{}, err
+	}
+
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionEnvironmentRegistered,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Registered",
+		Message: fmt.Sprintf("namespace %s is registered in Environment %s of project %s", namespace, env.Name, env.Project),
+	}, nil
+}
+
+// cleanupEnvironment deregisters the namespace from the Environment, deletes
+// the service endpoint and removes the generated ServiceAccount, RoleBinding
+// and token Secret. The Environment and its deployment history are kept.
+func (r *AgentReconciler) cleanupEnvironment(ctx context.Context, m *azdevopsv1alpha1.Agent) error {
+	logger := log.FromContext(ctx)
+
+	if st := m.Status.Environment.DeepCopy(); st != nil {
+		if m.Spec.Pool.AgentPoolRef != nil && m.Spec.Pool.URL == "" {
+			if _, err := r.applyAgentPool(ctx, m); err != nil {
+				return err
+			}
+		}
+		if m.Spec.Pool.URL == "" {
+			logger.Info("Azure DevOps organization unknown, skipping Environment cleanup", "Agent.Namespace", m.Namespace, "Agent.Name", m.Name)
+		} else {
+			ado := azdevops.NewClient(m.Spec.Pool.URL, m.Spec.Pool.Token)
+			if err := r.deregisterNamespace(ctx, ado, st); err != nil {
+				return err
+			}
+			if st.ServiceEndpointID != "" {
+				logger.Info("Deleting service endpoint in Azure DevOps", "Project", st.Project, "ServiceEndpoint.ID", st.ServiceEndpointID)
+				err := ado.DeleteServiceEndpoint(ctx, st.ServiceEndpointID, st.ProjectID)
+				if err != nil && !azdevops.IsNotFound(err) {
+					return err
+				}
+			}
+		}
+	}
+
+	selector := client.MatchingLabels(environmentLabelsForAgent(m))
+	bindings := &rbacv1.RoleBindingList{}
+	if err := r.List(ctx, bindings, selector); err != nil {
+		return err
+	}
+	for i := range bindings.Items {
+		logger.Info("Deleting RoleBinding", "RoleBinding.Namespace", bindings.Items[i].Namespace, "RoleBinding.Name", bindings.Items[i].Name)
+		if err := r.Delete(ctx, &bindings.Items[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	secrets := &corev1.SecretList{}
+	if err := r.List(ctx, secrets, selector); err != nil {
+		return err
+	}
+	for i := range secrets.Items {
+		logger.Info("Deleting Secret", "Secret.Namespace", secrets.Items[i].Namespace, "Secret.Name", secrets.Items[i].Name)
+		if err := r.Delete(ctx, &secrets.Items[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	accounts := &corev1.ServiceAccountList{}
+	if err := r.List(ctx, accounts, selector); err != nil {
+		return err
+	}
+	for i := range accounts.Items {
+		logger.Info("Deleting ServiceAccount", "ServiceAccount.Namespace", accounts.Items[i].Namespace, "ServiceAccount.Name", accounts.Items[i].Name)
+		if err := r.Delete(ctx, &accounts.Items[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	return r.setEnvironmentStatus(ctx, m, nil)
+}
+
+// deregisterNamespace removes the Kubernetes resource of the status from
+// its Environment and resets the resource id
+func (r *AgentReconciler) deregisterNamespace(ctx context.Context, ado *azdevops.Client, st *azdevopsv1alpha1.EnvironmentStatus) error {
+	if st.ResourceID == 0 {
+		return nil
+	}
+	log.FromContext(ctx).Info("Deregistering namespace from Environment", "Project", st.Project, "Environment.ID", st.EnvironmentID, "Namespace", st.Namespace)
+	err := ado.DeleteKubernetesResource(ctx, st.Project, st.EnvironmentID, st.ResourceID)
+	if err != nil && !azdevops.IsNotFound(err) {
+		return err
+	}
+	st.ResourceID = 0
+	return nil
+}
+
+// setEnvironmentStatus records the Azure DevOps ids in the Agent status
+func (r *AgentReconciler) setEnvironmentStatus(ctx context.Context, m *azdevopsv1alpha1.Agent, st *azdevopsv1alpha1.EnvironmentStatus) error {
+	if (st == nil && m.Status.Environment == nil) ||
+		(st != nil && m.Status.Environment != nil && *st == *m.Status.Environment) {
+		return nil
+	}
+	m.Status.Environment = st
+	return r.updateStatus(ctx, m)
+}
+
+func (r *AgentReconciler) environmentServiceAccountForAgent(m *azdevopsv1alpha1.Agent) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:    environmentLabelsForAgent(m),
+			Name:      environmentNameForAgent(m),
+			Namespace: environmentNamespaceForAgent(m),
+		},
+	}
+}
+
+func (r *AgentReconciler) environmentRoleBindingForAgent(m *azdevopsv1alpha1.Agent) *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:    environmentLabelsForAgent(m),
+			Name:      environmentNameForAgent(m),
+			Namespace: environmentNamespaceForAgent(m),
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     m.Spec.Environment.ClusterRole,
+		},
+		Subjects: []rbacv1.Subject{{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      environmentNameForAgent(m),
+			Namespace: environmentNamespaceForAgent(m),
+		}},
+	}
+}
+
+// environmentTokenForAgent requests a long lived token for the generated
+// ServiceAccount, Kubernetes fills the Secret with the token and CA
+func (r *AgentReconciler) environmentTokenForAgent(m *azdevopsv1alpha1.Agent) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:    environmentLabelsForAgent(m),
+			Name:      environmentNameForAgent(m) + "-token",
+			Namespace: environmentNamespaceForAgent(m),
+			Annotations: map[string]string{
+				corev1.ServiceAccountNameKey: environmentNameForAgent(m),
+			},
+		},
+		Type: corev1.SecretTypeServiceAccountToken,
+	}
+}
+
+// serviceEndpointForAgent is a Kubernetes service endpoint authenticating
+// with the ServiceAccount token
+func serviceEndpointForAgent(m *azdevopsv1alpha1.Agent, st *azdevopsv1alpha1.EnvironmentStatus, token *corev1.Secret) *azdevops.ServiceEndpoint {
+	name := environmentNameForAgent(m)
+	return &azdevops.ServiceEndpoint{
+		Name: name,
+		Type: "kubernetes",
+		URL:  m.Spec.Environment.ClusterURL,
+		Authorization: azdevops.EndpointAuthorization{
+			Scheme: "Token",
+			Parameters: map[string]string{
+				"apiToken":                  base64.StdEncoding.EncodeToString(token.Data[corev1.ServiceAccountTokenKey]),
+				"serviceAccountCertificate": base64.StdEncoding.EncodeToString(token.Data[corev1.ServiceAccountRootCAKey]),
+				"isCreatedFromSecretUpload": "true",
+			},
+		},
+		Data: map[string]string{
+			"authorizationType": "ServiceAccount",
+		},
+		References: []azdevops.ServiceEndpointProjectReference{{
+			ProjectReference: azdevops.Project{ID: st.ProjectID, Name: st.Project},
+			Name:             name,
+		}},
+	}
+}
+
+// serviceEndpointHash identifies the cluster URL and token of the service
+// endpoint, a rotated token or changed URL updates the endpoint
+func serviceEndpointHash(m *azdevopsv1alpha1.Agent, token *corev1.Secret) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", m.Spec.Environment.ClusterURL,
+		token.Data[corev1.ServiceAccountTokenKey], token.Data[corev1.ServiceAccountRootCAKey])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// environmentNamespaceForAgent returns the namespace registered in the Environment
+func environmentNamespaceForAgent(m *azdevopsv1alpha1.Agent) string {
+	if m.Spec.Environment != nil && m.Spec.Environment.Namespace != "" {
+		return m.Spec.Environment.Namespace
+	}
+	return m.Namespace
+}
+
+// environmentNameForAgent is the name of the generated ServiceAccount,
+// RoleBinding and service endpoint
+func environmentNameForAgent(m *azdevopsv1alpha1.Agent) string {
+	return fmt.Sprintf("azdevops-env-%s-%s", m.Namespace, m.Name)
+}
+
+// environmentLabelsForAgent selects the generated objects of the Agent
+// across namespaces, they differ from the rbac labels so pruneRBAC leaves
+// the RoleBinding alone
+func environmentLabelsForAgent(m *azdevopsv1alpha1.Agent) map[string]string {
+	return map[string]string{
+		"app":             "azdevops-environment",
+		"agent_cr":        m.Name,
+		"agent_namespace": m.Namespace,
+	}
+}
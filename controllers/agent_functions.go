@@ -17,12 +17,22 @@ limitations under the License.
 package controllers
 
 import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
 	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func (r *AgentReconciler) deploymentForAgent(m *azdevopsv1alpha1.Agent) *appsv1.Deployment {
@@ -30,9 +40,86 @@ func (r *AgentReconciler) deploymentForAgent(m *azdevopsv1alpha1.Agent) *appsv1.
 	replicas := m.Spec.Size
 
 	if m.Spec.Image == "" {
-		m.Spec.Image = "bartvanbenthem/agent:latest"
+		m.Spec.Image = defaultAgentImage
+	}
+
+	resources := corev1.ResourceRequirements{}
+	if m.Spec.Resources != nil {
+		resources = *m.Spec.Resources
+	}
+
+	var volumes []corev1.Volume
+	var volumeMounts []corev1.VolumeMount
+	var env []corev1.EnvVar
+
+	// share the tool and package caches between the agents
+	cacheVolumes, cacheMounts, cacheEnv := cachesForAgent(m)
+	volumes = append(volumes, cacheVolumes...)
+	volumeMounts = append(volumeMounts, cacheMounts...)
+	env = append(env, cacheEnv...)
+
+	// send the traffic of the agent and its jobs through the proxy
+	env = append(env, proxyEnvForAgent(m)...)
+
+	// install the selected agent version
+	env = append(env, agentVersionEnv(m)...)
+
+	gracePeriod := defaultGracePeriodSeconds
+	if m.Spec.ScaleDown.GracePeriodSeconds != nil {
+		gracePeriod = *m.Spec.ScaleDown.GracePeriodSeconds
+	}
+
+	// run the agents under the dedicated ServiceAccount when rbac is configured
+	serviceAccount := ""
+	if m.Spec.RBAC != nil {
+		serviceAccount = m.Name
 	}
 
+	podSecurityContext, securityContext := securityContextsForAgent(m)
+
+	// the restricted profile has a read-only root filesystem, the agent
+	// writes to emptyDirs instead
+	writableVolumes, writableMounts, writableEnv := writableVolumesForAgent(m)
+	volumes = append(volumes, writableVolumes...)
+	volumeMounts = append(volumeMounts, writableMounts...)
+	env = append(env, writableEnv...)
+
+	// install the SSH keys, or load them in an ssh-agent sidecar
+	initContainers, sidecars, sshVolumes, sshMounts, sshEnv := sshForAgent(m, securityContext)
+	// trust the operator CA bundle next to the CAs of the image
+	caContainers, caVolumes, caMounts, caEnv := r.caBundleForAgent(m, securityContext)
+	initContainers = append(initContainers, caContainers...)
+	volumes = append(volumes, caVolumes...)
+	volumeMounts = append(volumeMounts, caMounts...)
+	env = append(env, caEnv...)
+	volumes = append(volumes, sshVolumes...)
+	volumeMounts = append(volumeMounts, sshMounts...)
+	env = append(env, sshEnv...)
+
+	// log in to the registries of the container jobs
+	dockerVolumes, dockerMounts, dockerEnv := dockerConfigForAgent(m)
+	volumes = append(volumes, dockerVolumes...)
+	volumeMounts = append(volumeMounts, dockerMounts...)
+	env = append(env, dockerEnv...)
+
+	// copy the tools into a directory on the PATH
+	toolContainers, toolVolumes, toolMounts := toolsForAgent(m, securityContext)
+	initContainers = append(initContainers, toolContainers...)
+	volumes = append(volumes, toolVolumes...)
+	volumeMounts = append(volumeMounts, toolMounts...)
+
+	// run the startup scripts before the agent, both see the tools
+	scriptVolumes, scriptMounts, command, args := startupScriptsForAgent(m)
+	volumes = append(volumes, scriptVolumes...)
+	volumeMounts = append(volumeMounts, scriptMounts...)
+	command, args = toolsCommand(m, command, args)
+
+	// the volumes and environment of the Agent are added last, so its
+	// variables override the ones set by the operator
+	volumes = append(volumes, m.Spec.Volumes...)
+	volumeMounts = append(volumeMounts, m.Spec.VolumeMounts...)
+	env = append(env, m.Spec.Env...)
+
 	dep := appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      m.Name,
@@ -48,10 +135,31 @@ func (r *AgentReconciler) deploymentForAgent(m *azdevopsv1alpha1.Agent) *appsv1.
 					Labels: ls,
 				},
 				Spec: corev1.PodSpec{
+					TerminationGracePeriodSeconds: &gracePeriod,
+					ServiceAccountName:            serviceAccount,
+					ImagePullSecrets:              imagePullSecretsForAgent(m),
+					AutomountServiceAccountToken:  automountTokenForAgent(m),
+					RuntimeClassName:              m.Spec.RuntimeClassName,
+					SecurityContext:               podSecurityContext,
+					Volumes:                       volumes,
+					InitContainers:                initContainers,
 					Containers: []corev1.Container{{
-						Image: m.Spec.Image,
-						Name:  "kubepodcreation",
-						Env: []corev1.EnvVar{
+						Image:           m.Spec.Image,
+						Name:            "kubepodcreation",
+						Command:         command,
+						Args:            args,
+						SecurityContext: securityContext,
+						Resources:       resources,
+						VolumeMounts:    volumeMounts,
+						// wait for a running job to finish before the agent is stopped
+						Lifecycle: &corev1.Lifecycle{
+							PreStop: &corev1.Handler{
+								Exec: &corev1.ExecAction{
+									Command: []string{"/bin/sh", "-c", waitForJobScript},
+								},
+							},
+						},
+						Env: append([]corev1.EnvVar{
 							{
 								Name: "AZP_URL",
 								ValueFrom: &corev1.EnvVarSource{
@@ -82,18 +190,25 @@ func (r *AgentReconciler) deploymentForAgent(m *azdevopsv1alpha1.Agent) *appsv1.
 									},
 								},
 							},
-						},
+						}, env...),
+						EnvFrom: m.Spec.EnvFrom,
 					}},
 				},
 			},
 		},
 	}
+	if len(sidecars) > 0 {
+		// the sidecars wait for the job of the agent before they stop
+		shareProcessNamespace := true
+		dep.Spec.Template.Spec.ShareProcessNamespace = &shareProcessNamespace
+		dep.Spec.Template.Spec.Containers = append(dep.Spec.Template.Spec.Containers, sidecars...)
+	}
 	// Set Agent instance as the owner and controller
 	ctrl.SetControllerReference(m, &dep, r.Scheme)
 	return &dep
 }
 
-func (r *AgentReconciler) secretForAgent(m *azdevopsv1alpha1.Agent) *corev1.Secret {
+func (r *AgentReconciler) secretForAgent(m *azdevopsv1alpha1.Agent, proxyCredentials *url.Userinfo) *corev1.Secret {
 	ls := labelsForAgent(m.Name)
 
 	azp := azdevopsv1alpha1.AzDevPool{
@@ -104,37 +219,204 @@ func (r *AgentReconciler) secretForAgent(m *azdevopsv1alpha1.Agent) *corev1.Secr
 		WorkDir:   m.Spec.Pool.WorkDir,
 	}
 
-	proxy := azdevopsv1alpha1.ProxyConfig{
-		HTTPProxy:  m.Spec.Proxy.HTTPProxy,
-		HTTPSProxy: m.Spec.Proxy.HTTPSProxy,
-		FTPProxy:   m.Spec.Proxy.FTPProxy,
-		NoProxy:    m.Spec.Proxy.NoProxy,
+	secdata := r.proxyDataForAgent(m, proxyCredentials)
+	secdata["AZP_POOL"] = []byte(azp.PoolName)
+	secdata["AZP_URL"] = []byte(azp.URL)
+	secdata["AZP_TOKEN"] = []byte(azp.Token)
+	secdata["AZP_WORK"] = []byte(azp.WorkDir)
+	secdata["AZP_AGENT_NAME"] = []byte(azp.AgentName)
+	secdata["AGENT_MTU_VALUE"] = []byte(m.Spec.MTUValue)
+	if caBundle := r.defaults().CABundle; caBundle != "" {
+		secdata[caBundleKey] = []byte(caBundle)
 	}
 
-	secdata := map[string]string{}
-	secdata["AZP_POOL"] = string(azp.PoolName)
-	secdata["AZP_URL"] = string(azp.URL)
-	secdata["AZP_TOKEN"] = string(azp.Token)
-	secdata["AZP_WORK"] = string(azp.WorkDir)
-	secdata["AZP_AGENT_NAME"] = string(azp.AgentName)
-	secdata["HTTP_PROXY"] = string(proxy.HTTPProxy)
-	secdata["HTTPS_PROXY"] = string(proxy.HTTPSProxy)
-	secdata["FTP_PROXY"] = string(proxy.FTPProxy)
-	secdata["NO_PROXY"] = string(proxy.NoProxy)
-	secdata["AGENT_MTU_VALUE"] = string(m.Spec.MTUValue)
-
 	sec := corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Labels:    ls,
 			Name:      m.Name,
 			Namespace: m.Namespace,
 		},
-		StringData: secdata,
+		Data: secdata,
 	}
-
+	// Set Agent instance as the owner and controller
+	ctrl.SetControllerReference(m, &sec, r.Scheme)
 	return &sec
 }
 
+func (r *AgentReconciler) podDisruptionBudgetForAgent(m *azdevopsv1alpha1.Agent) *policyv1beta1.PodDisruptionBudget {
+	ls := labelsForAgent(m.Name)
+
+	spec := policyv1beta1.PodDisruptionBudgetSpec{
+		Selector: &metav1.LabelSelector{
+			MatchLabels: ls,
+		},
+	}
+	switch {
+	case m.Spec.Disruption.MinAvailable != nil:
+		minAvailable := *m.Spec.Disruption.MinAvailable
+		// a minimum of the size or more would block every node drain, a
+		// percentage is rounded up like the disruption controller does
+		resolved, err := intstr.GetScaledValueFromIntOrPercent(&minAvailable, int(m.Spec.Size), true)
+		if err == nil && resolved >= int(m.Spec.Size) {
+			capped := 0
+			if m.Spec.Size > 0 {
+				capped = int(m.Spec.Size) - 1
+			}
+			minAvailable = intstr.FromInt(capped)
+		}
+		spec.MinAvailable = &minAvailable
+	case m.Spec.Disruption.MaxUnavailable != nil:
+		maxUnavailable := *m.Spec.Disruption.MaxUnavailable
+		spec.MaxUnavailable = &maxUnavailable
+	default:
+		maxUnavailable := intstr.FromInt(1)
+		spec.MaxUnavailable = &maxUnavailable
+	}
+
+	pdb := policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:    ls,
+			Name:      m.Name,
+			Namespace: m.Namespace,
+		},
+		Spec: spec,
+	}
+	// Set Agent instance as the owner and controller
+	ctrl.SetControllerReference(m, &pdb, r.Scheme)
+	return &pdb
+}
+
+func (r *AgentReconciler) networkPolicyForAgent(m *azdevopsv1alpha1.Agent) *networkingv1.NetworkPolicy {
+	ls := labelsForAgent(m.Name)
+	udp := corev1.ProtocolUDP
+	tcp := corev1.ProtocolTCP
+	dns := intstr.FromInt(53)
+
+	// DNS is only allowed to the cluster DNS
+	egress := []networkingv1.NetworkPolicyEgressRule{{
+		Ports: []networkingv1.NetworkPolicyPort{
+			{Protocol: &udp, Port: &dns},
+			{Protocol: &tcp, Port: &dns},
+		},
+		To: []networkingv1.NetworkPolicyPeer{{
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"kubernetes.io/metadata.name": "kube-system"},
+			},
+			PodSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"k8s-app": "kube-dns"},
+			},
+		}},
+	}}
+	for _, proxy := range []string{m.Spec.Proxy.HTTPProxy, m.Spec.Proxy.HTTPSProxy, m.Spec.Proxy.FTPProxy} {
+		if rule, ok := egressRuleForProxy(proxy); ok {
+			egress = append(egress, rule)
+		}
+	}
+	for _, cidr := range m.Spec.NetworkPolicy.AllowedCIDRs {
+		egress = append(egress, networkingv1.NetworkPolicyEgressRule{
+			To: []networkingv1.NetworkPolicyPeer{{
+				IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+			}},
+		})
+	}
+	for _, ns := range m.Spec.NetworkPolicy.AllowedNamespaces {
+		egress = append(egress, networkingv1.NetworkPolicyEgressRule{
+			To: []networkingv1.NetworkPolicyPeer{{
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"kubernetes.io/metadata.name": ns},
+				},
+			}},
+		})
+	}
+
+	np := networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:    ls,
+			Name:      m.Name,
+			Namespace: m.Namespace,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: ls,
+			},
+			// no ingress rules are set, so all ingress is denied
+			PolicyTypes: []networkingv1.PolicyType{
+				networkingv1.PolicyTypeIngress,
+				networkingv1.PolicyTypeEgress,
+			},
+			Egress: egress,
+		},
+	}
+	// Set Agent instance as the owner and controller
+	ctrl.SetControllerReference(m, &np, r.Scheme)
+	return &np
+}
+
+// egressRuleForProxy allows traffic to a proxy URL addressed by IP.
+// NetworkPolicies can not select host names, the addresses of a proxy
+// addressed by name have to be allowed with the allowed CIDRs.
+func egressRuleForProxy(proxy string) (networkingv1.NetworkPolicyEgressRule, bool) {
+	rule := networkingv1.NetworkPolicyEgressRule{}
+	if proxy == "" {
+		return rule, false
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Hostname() == "" {
+		return rule, false
+	}
+	ip := net.ParseIP(u.Hostname())
+	if ip == nil {
+		return rule, false
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return rule, false
+	}
+	tcp := corev1.ProtocolTCP
+	p := intstr.FromInt(portNumber)
+	rule.Ports = []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &p}}
+
+	cidr := ip.String() + "/32"
+	if ip.To4() == nil {
+		cidr = ip.String() + "/128"
+	}
+	rule.To = []networkingv1.NetworkPolicyPeer{{
+		IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+	}}
+	return rule, true
+}
+
+// validateNetworkPolicy checks the allowed CIDRs, an invalid CIDR makes the
+// API server reject the whole NetworkPolicy
+func validateNetworkPolicy(np *azdevopsv1alpha1.NetworkPolicyConfig) error {
+	for _, cidr := range np.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("allowedCIDRs %q is not a CIDR", cidr)
+		}
+	}
+	return nil
+}
+
+// uncachedReader reads cluster scoped objects, the cache can not serve them
+// when it is restricted to multiple namespaces
+func (r *AgentReconciler) uncachedReader() client.Reader {
+	if r.APIReader == nil {
+		return r.Client
+	}
+	return r.APIReader
+}
+
 func labelsForAgent(name string) map[string]string {
 	return map[string]string{"app": "azdevops-agent", "agent_cr": name}
 }
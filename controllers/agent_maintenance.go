@@ -0,0 +1,148 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/azdevops-agent-operator/pkg/azdevops"
+)
+
+// maintenanceDisabledAnnotation marks the pods of the agents that were
+// disabled for maintenance, they are enabled again after the maintenance
+const maintenanceDisabledAnnotation = "azdevops.gofound.nl/disabled-for-maintenance"
+
+// isPaused returns true if the reconciliation of the owned resources of m
+// is paused by the spec or the annotation
+func isPaused(m *azdevopsv1alpha1.Agent) bool {
+	return m.Spec.Paused || m.Annotations[azdevopsv1alpha1.PausedAnnotation] == "true"
+}
+
+// inMaintenance returns true if the agents of m should not receive jobs
+func inMaintenance(m *azdevopsv1alpha1.Agent) bool {
+	return m.Spec.Maintenance || m.Annotations[azdevopsv1alpha1.MaintenanceAnnotation] == "true"
+}
+
+// startMaintenance disables the registered agents of m in Azure DevOps and
+// marks their pods, agents that register during the maintenance are
+// disabled on the next pass.
+func (r *AgentReconciler) startMaintenance(ctx context.Context, m *azdevopsv1alpha1.Agent) (metav1.Condition, error) {
+	logger := log.FromContext(ctx)
+
+	pods, err := r.agentPods(ctx, m)
+	if err != nil {
+		return metav1.Condition{}, err
+	}
+	ado := azdevops.NewClient(m.Spec.Pool.URL, m.Spec.Pool.Token)
+	pool, err := ado.GetPoolByName(ctx, m.Spec.Pool.PoolName)
+	if err != nil {
+		return metav1.Condition{}, err
+	}
+	registered, err := registeredAgents(ctx, ado, pool.ID)
+	if err != nil {
+		return metav1.Condition{}, err
+	}
+
+	disabled := 0
+	for i := range pods {
+		pod := &pods[i]
+		a, ok := registered[agentNameForPod(pod)]
+		if !ok || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if a.Enabled {
+			// mark the pod first, so the agent is enabled again when
+			// disabling it is interrupted
+			if pod.Annotations[maintenanceDisabledAnnotation] != "true" {
+				patch := client.MergeFrom(pod.DeepCopy())
+				if pod.Annotations == nil {
+					pod.Annotations = map[string]string{}
+				}
+				pod.Annotations[maintenanceDisabledAnnotation] = "true"
+				if err := r.Patch(ctx, pod, patch); err != nil {
+					return metav1.Condition{}, err
+				}
+			}
+			logger.Info("Disabling agent for maintenance", "Pod.Name", pod.Name, "Agent.ID", a.ID)
+			if err := ado.SetAgentEnabled(ctx, pool.ID, a.ID, false); err != nil {
+				return metav1.Condition{}, err
+			}
+		}
+		disabled++
+	}
+
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionMaintenance,
+		Status:  metav1.ConditionTrue,
+		Reason:  "AgentsDisabled",
+		Message: fmt.Sprintf("%d registered agents are disabled in Azure DevOps", disabled),
+	}, nil
+}
+
+// endMaintenance enables the agents that were disabled for maintenance,
+// agents that are selected for a scale down stay disabled
+func (r *AgentReconciler) endMaintenance(ctx context.Context, m *azdevopsv1alpha1.Agent) error {
+	logger := log.FromContext(ctx)
+
+	pods, err := r.agentPods(ctx, m)
+	if err != nil {
+		return err
+	}
+	marked := []corev1.Pod{}
+	for _, pod := range pods {
+		if pod.Annotations[maintenanceDisabledAnnotation] == "true" {
+			marked = append(marked, pod)
+		}
+	}
+	if len(marked) == 0 {
+		return nil
+	}
+
+	ado := azdevops.NewClient(m.Spec.Pool.URL, m.Spec.Pool.Token)
+	pool, err := ado.GetPoolByName(ctx, m.Spec.Pool.PoolName)
+	if err != nil {
+		return err
+	}
+	registered, err := registeredAgents(ctx, ado, pool.ID)
+	if err != nil {
+		return err
+	}
+
+	for i := range marked {
+		pod := &marked[i]
+		a, ok := registered[agentNameForPod(pod)]
+		if ok && !a.Enabled && pod.DeletionTimestamp == nil && pod.Annotations[podDeletionCostAnnotation] != scaleDownDeletionCost {
+			logger.Info("Enabling agent after maintenance", "Pod.Name", pod.Name, "Agent.ID", a.ID)
+			if err := ado.SetAgentEnabled(ctx, pool.ID, a.ID, true); err != nil {
+				return err
+			}
+		}
+		patch := client.MergeFrom(pod.DeepCopy())
+		delete(pod.Annotations, maintenanceDisabledAnnotation)
+		if err := r.Patch(ctx, pod, patch); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
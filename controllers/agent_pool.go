@@ -0,0 +1,99 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+// agentPoolRefIndex indexes Agents by the name of the AgentPool they reference
+const agentPoolRefIndex = "spec.pool.agentPoolRef.name"
+
+// applyAgentPool sets the url, token and pool name of the referenced
+// AgentPool on the Agent. The Agent is only changed in memory.
+func (r *AgentReconciler) applyAgentPool(ctx context.Context, m *azdevopsv1alpha1.Agent) (metav1.Condition, error) {
+	name := m.Spec.Pool.AgentPoolRef.Name
+	agentPool := azdevopsv1alpha1.AgentPool{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: m.Namespace}, &agentPool)
+	if err != nil && errors.IsNotFound(err) {
+		return metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionPoolResolved,
+			Status:  metav1.ConditionFalse,
+			Reason:  "NotFound",
+			Message: fmt.Sprintf("AgentPool %s does not exist", name),
+		}, nil
+	} else if err != nil {
+		return metav1.Condition{}, err
+	}
+
+	// agents can only register once the pool exists in Azure DevOps
+	if !meta.IsStatusConditionTrue(agentPool.Status.Conditions, azdevopsv1alpha1.ConditionPoolReady) {
+		return metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionPoolResolved,
+			Status:  metav1.ConditionFalse,
+			Reason:  "NotReady",
+			Message: fmt.Sprintf("AgentPool %s is not provisioned in Azure DevOps", name),
+		}, nil
+	}
+
+	m.Spec.Pool.URL = agentPool.Spec.URL
+	m.Spec.Pool.Token = agentPool.Spec.Token
+	m.Spec.Pool.PoolName = poolNameForAgentPool(&agentPool)
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionPoolResolved,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Resolved",
+		Message: fmt.Sprintf("agents register in pool %s with id %d", m.Spec.Pool.PoolName, agentPool.Status.PoolID),
+	}, nil
+}
+
+// agentsForAgentPool requeues the Agents referencing a changed AgentPool
+func (r *AgentReconciler) agentsForAgentPool(obj client.Object) []reconcile.Request {
+	agents := &azdevopsv1alpha1.AgentList{}
+	if err := r.List(context.Background(), agents, client.InNamespace(obj.GetNamespace()),
+		client.MatchingFields{agentPoolRefIndex: obj.GetName()}); err != nil {
+		log.Log.Error(err, "Failed to list Agents referencing AgentPool", "AgentPool.Namespace", obj.GetNamespace(), "AgentPool.Name", obj.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, agent := range agents.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: agent.Name, Namespace: agent.Namespace},
+		})
+	}
+	return requests
+}
+
+// agentPoolRefName extracts the AgentPool name for the agentPoolRefIndex
+func agentPoolRefName(obj client.Object) []string {
+	agent := obj.(*azdevopsv1alpha1.Agent)
+	if agent.Spec.Pool.AgentPoolRef == nil {
+		return nil
+	}
+	return []string{agent.Spec.Pool.AgentPoolRef.Name}
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+// profileRefIndex indexes Agents by the name of the AgentProfile they reference
+const profileRefIndex = "spec.profileRef.name"
+
+// applyProfile merges the referenced AgentProfile into the Agent, settings
+// set on the Agent are kept. The Agent is only changed in memory.
+func (r *AgentReconciler) applyProfile(ctx context.Context, m *azdevopsv1alpha1.Agent) (metav1.Condition, error) {
+	profile := azdevopsv1alpha1.AgentProfile{}
+	err := r.uncachedReader().Get(ctx, types.NamespacedName{Name: m.Spec.ProfileRef.Name}, &profile)
+	if err != nil && errors.IsNotFound(err) {
+		return metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionProfileResolved,
+			Status:  metav1.ConditionFalse,
+			Reason:  "NotFound",
+			Message: fmt.Sprintf("AgentProfile %s does not exist", m.Spec.ProfileRef.Name),
+		}, nil
+	} else if err != nil {
+		return metav1.Condition{}, err
+	}
+
+	mergeTemplate(&m.Spec, &profile.Spec.Template)
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionProfileResolved,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Resolved",
+		Message: fmt.Sprintf("settings are inherited from AgentProfile %s generation %d", profile.Name, profile.Generation),
+	}, nil
+}
+
+// mergeTemplate fills the settings the Agent does not set from the template
+func mergeTemplate(spec *azdevopsv1alpha1.AgentSpec, t *azdevopsv1alpha1.AgentTemplate) {
+	t = t.DeepCopy()
+
+	if spec.Image == "" {
+		spec.Image = t.Image
+	}
+	if spec.Resources == nil {
+		spec.Resources = t.Resources
+	}
+	if spec.Proxy.HTTPProxy == "" {
+		spec.Proxy.HTTPProxy = t.Proxy.HTTPProxy
+	}
+	if spec.Proxy.HTTPSProxy == "" {
+		spec.Proxy.HTTPSProxy = t.Proxy.HTTPSProxy
+	}
+	if spec.Proxy.FTPProxy == "" {
+		spec.Proxy.FTPProxy = t.Proxy.FTPProxy
+	}
+	if spec.Proxy.NoProxy == "" {
+		spec.Proxy.NoProxy = t.Proxy.NoProxy
+	}
+	if spec.Proxy.CredentialsSecretRef == nil {
+		spec.Proxy.CredentialsSecretRef = t.Proxy.CredentialsSecretRef
+	}
+	if spec.MTUValue == "" {
+		spec.MTUValue = t.MTUValue
+	}
+	if spec.ScaleDown.GracePeriodSeconds == nil {
+		spec.ScaleDown.GracePeriodSeconds = t.ScaleDown.GracePeriodSeconds
+	}
+	if spec.Disruption == nil {
+		spec.Disruption = t.Disruption
+	}
+	if spec.NetworkPolicy == nil {
+		spec.NetworkPolicy = t.NetworkPolicy
+	}
+	if spec.SecurityProfile == "" {
+		spec.SecurityProfile = t.SecurityProfile
+	}
+	if spec.RuntimeClassName == nil {
+		spec.RuntimeClassName = t.RuntimeClassName
+	}
+	if len(spec.Schedules) == 0 {
+		spec.Schedules = t.Schedules
+	}
+	if spec.AgentVersion == nil {
+		spec.AgentVersion = t.AgentVersion
+	}
+	if spec.Rollout == nil {
+		spec.Rollout = t.Rollout
+	}
+	if spec.Caches == nil {
+		spec.Caches = t.Caches
+	}
+	// lists are inherited as a whole, they are not merged with the lists
+	// of the Agent
+	if len(spec.Tools) == 0 {
+		spec.Tools = t.Tools
+	}
+	if len(spec.Env) == 0 {
+		spec.Env = t.Env
+	}
+	if len(spec.EnvFrom) == 0 {
+		spec.EnvFrom = t.EnvFrom
+	}
+	if len(spec.Volumes) == 0 {
+		spec.Volumes = t.Volumes
+	}
+	if len(spec.VolumeMounts) == 0 {
+		spec.VolumeMounts = t.VolumeMounts
+	}
+	if spec.StartupScripts == nil {
+		spec.StartupScripts = t.StartupScripts
+	}
+	if spec.SSH == nil {
+		spec.SSH = t.SSH
+	}
+	if len(spec.ImagePullSecrets) == 0 {
+		spec.ImagePullSecrets = t.ImagePullSecrets
+	}
+	if spec.DockerConfig == nil {
+		spec.DockerConfig = t.DockerConfig
+	}
+}
+
+// updateStatus writes the status of m and keeps the settings resolved from
+// the profile, pool, defaults and schedules, the API server returns the
+// stored spec
+func (r *AgentReconciler) updateStatus(ctx context.Context, m *azdevopsv1alpha1.Agent) error {
+	spec := m.Spec.DeepCopy()
+	err := r.Status().Update(ctx, m)
+	m.Spec = *spec
+	return err
+}
+
+// removeCondition removes a condition that no longer applies from the Agent status
+func (r *AgentReconciler) removeCondition(ctx context.Context, m *azdevopsv1alpha1.Agent, conditionType string) error {
+	if meta.FindStatusCondition(m.Status.Conditions, conditionType) == nil {
+		return nil
+	}
+	meta.RemoveStatusCondition(&m.Status.Conditions, conditionType)
+	return r.updateStatus(ctx, m)
+}
+
+// agentsForProfile requeues the Agents referencing a changed AgentProfile
+func (r *AgentReconciler) agentsForProfile(obj client.Object) []reconcile.Request {
+	agents := &azdevopsv1alpha1.AgentList{}
+	if err := r.List(context.Background(), agents, client.MatchingFields{profileRefIndex: obj.GetName()}); err != nil {
+		log.Log.Error(err, "Failed to list Agents referencing AgentProfile", "AgentProfile.Name", obj.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, agent := range agents.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: agent.Name, Namespace: agent.Namespace},
+		})
+	}
+	return requests
+}
+
+// profileRefName extracts the AgentProfile name for the profileRefIndex
+func profileRefName(obj client.Object) []string {
+	agent := obj.(*azdevopsv1alpha1.Agent)
+	if agent.Spec.ProfileRef == nil {
+		return nil
+	}
+	return []string{agent.Spec.ProfileRef.Name}
+}
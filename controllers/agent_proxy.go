@@ -0,0 +1,226 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+const (
+	// proxySecretRefIndex indexes Agents by the name of their proxy credentials Secret
+	proxySecretRefIndex = "spec.proxy.credentialsSecretRef.name"
+	// proxyUsernameKey and proxyPasswordKey are the keys of the proxy credentials Secret
+	proxyUsernameKey = "username"
+	proxyPasswordKey = "password"
+)
+
+// clusterNoProxy are the addresses inside every cluster that are never
+// reached through the proxy
+var clusterNoProxy = []string{"localhost", "127.0.0.1", ".svc", ".cluster.local"}
+
+// proxyEnv are the proxy variables of the agent Secret, they are set in
+// upper and lower case as tools read either one
+var proxyEnv = []string{"HTTP_PROXY", "HTTPS_PROXY", "FTP_PROXY", "NO_PROXY"}
+
+// proxyCredentials reads the username and password of the proxy from the
+// referenced Secret, it returns nil when no Secret is referenced
+func (r *AgentReconciler) proxyCredentials(ctx context.Context, m *azdevopsv1alpha1.Agent) (*url.Userinfo, metav1.Condition, error) {
+	ref := m.Spec.Proxy.CredentialsSecretRef
+	if ref == nil {
+		return nil, metav1.Condition{}, nil
+	}
+	sec := corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: m.Namespace}, &sec)
+	if err != nil && errors.IsNotFound(err) {
+		return nil, metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionProxyCredentialsResolved,
+			Status:  metav1.ConditionFalse,
+			Reason:  "SecretNotFound",
+			Message: fmt.Sprintf("Secret %s not found", ref.Name),
+		}, nil
+	} else if err != nil {
+		return nil, metav1.Condition{}, err
+	}
+
+	username, password := sec.Data[proxyUsernameKey], sec.Data[proxyPasswordKey]
+	if len(username) == 0 || len(password) == 0 {
+		return nil, metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionProxyCredentialsResolved,
+			Status:  metav1.ConditionFalse,
+			Reason:  "KeyNotFound",
+			Message: fmt.Sprintf("Secret %s needs the keys %s and %s", ref.Name, proxyUsernameKey, proxyPasswordKey),
+		}, nil
+	}
+	return url.UserPassword(string(username), string(password)), metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionProxyCredentialsResolved,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Resolved",
+		Message: fmt.Sprintf("proxy credentials are read from Secret %s", ref.Name),
+	}, nil
+}
+
+// proxyDataForAgent returns the proxy settings stored in the agent Secret.
+// The proxy urls include the credentials, the agent reads its own proxy
+// from VSTS_HTTP_PROXY with the credentials in separate variables. NO_PROXY
+// is extended with the cluster internal addresses.
+func (r *AgentReconciler) proxyDataForAgent(m *azdevopsv1alpha1.Agent, credentials *url.Userinfo) map[string][]byte {
+	p := m.Spec.Proxy
+	data := map[string][]byte{
+		"HTTP_PROXY":  []byte(proxyURLWithCredentials(p.HTTPProxy, credentials)),
+		"HTTPS_PROXY": []byte(proxyURLWithCredentials(p.HTTPSProxy, credentials)),
+		"FTP_PROXY":   []byte(proxyURLWithCredentials(p.FTPProxy, credentials)),
+		"NO_PROXY":    []byte(p.NoProxy),
+	}
+	if p.HTTPProxy != "" || p.HTTPSProxy != "" || p.FTPProxy != "" {
+		data["NO_PROXY"] = []byte(noProxyForAgent(p.NoProxy, r.defaults().ClusterNoProxy))
+	}
+	agentProxy := p.HTTPSProxy
+	if agentProxy == "" {
+		agentProxy = p.HTTPProxy
+	}
+	if agentProxy == "" {
+		return data
+	}
+	data["VSTS_HTTP_PROXY"] = []byte(agentProxy)
+	if credentials != nil {
+		password, _ := credentials.Password()
+		data["VSTS_HTTP_PROXY_USERNAME"] = []byte(credentials.Username())
+		data["VSTS_HTTP_PROXY_PASSWORD"] = []byte(password)
+	}
+	return data
+}
+
+// proxyURLWithCredentials adds the escaped credentials to a proxy url, a
+// url that can not be parsed or already has credentials is kept
+func proxyURLWithCredentials(proxy string, credentials *url.Userinfo) string {
+	if proxy == "" || credentials == nil {
+		return proxy
+	}
+	withScheme := proxy
+	if !strings.Contains(proxy, "://") {
+		withScheme = "http://" + proxy
+	}
+	u, err := url.Parse(withScheme)
+	if err != nil || u.Host == "" || u.User != nil {
+		return proxy
+	}
+	u.User = credentials
+	return u.String()
+}
+
+// noProxyForAgent appends the cluster internal addresses and the Kubernetes
+// API server to the NO_PROXY of the Agent, duplicates are left out
+func noProxyForAgent(noProxy string, cluster []string) string {
+	var entries []string
+	seen := map[string]bool{}
+	add := func(entry string) {
+		entry = strings.TrimSpace(entry)
+		if entry != "" && !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	for _, entry := range strings.Split(noProxy, ",") {
+		add(entry)
+	}
+	for _, entry := range clusterNoProxy {
+		add(entry)
+	}
+	add(os.Getenv("KUBERNETES_SERVICE_HOST"))
+	for _, entry := range cluster {
+		add(entry)
+	}
+	return strings.Join(entries, ",")
+}
+
+// proxyEnvForAgent returns the proxy variables of the agent container, they
+// are optional so pods do not fail before the Secret is updated
+func proxyEnvForAgent(m *azdevopsv1alpha1.Agent) []corev1.EnvVar {
+	p := m.Spec.Proxy
+	if p.HTTPProxy == "" && p.HTTPSProxy == "" && p.FTPProxy == "" {
+		return nil
+	}
+
+	optional := true
+	fromSecret := func(name, key string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: m.Name},
+					Key:                  key,
+					Optional:             &optional,
+				},
+			},
+		}
+	}
+	var env []corev1.EnvVar
+	for _, key := range proxyEnv {
+		env = append(env, fromSecret(key, key), fromSecret(strings.ToLower(key), key))
+	}
+	if p.HTTPProxy != "" || p.HTTPSProxy != "" {
+		env = append(env, fromSecret("VSTS_HTTP_PROXY", "VSTS_HTTP_PROXY"))
+		if p.CredentialsSecretRef != nil {
+			env = append(env,
+				fromSecret("VSTS_HTTP_PROXY_USERNAME", "VSTS_HTTP_PROXY_USERNAME"),
+				fromSecret("VSTS_HTTP_PROXY_PASSWORD", "VSTS_HTTP_PROXY_PASSWORD"),
+			)
+		}
+	}
+	return env
+}
+
+// agentsForProxySecret requeues the Agents referencing a changed proxy
+// credentials Secret
+func (r *AgentReconciler) agentsForProxySecret(obj client.Object) []reconcile.Request {
+	agents := &azdevopsv1alpha1.AgentList{}
+	if err := r.List(context.Background(), agents, client.InNamespace(obj.GetNamespace()),
+		client.MatchingFields{proxySecretRefIndex: obj.GetName()}); err != nil {
+		log.Log.Error(err, "Failed to list Agents referencing Secret", "Secret.Namespace", obj.GetNamespace(), "Secret.Name", obj.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, agent := range agents.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{Name: agent.Name, Namespace: agent.Namespace},
+		})
+	}
+	return requests
+}
+
+// proxySecretRefName extracts the Secret name for the proxySecretRefIndex
+func proxySecretRefName(obj client.Object) []string {
+	agent := obj.(*azdevopsv1alpha1.Agent)
+	if agent.Spec.Proxy.CredentialsSecretRef == nil {
+		return nil
+	}
+	return []string{agent.Spec.Proxy.CredentialsSecretRef.Name}
+}
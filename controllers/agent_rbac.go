@@ -0,0 +1,382 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+// agentFinalizer removes the resources the Agent can not own, like
+// Roles and RoleBindings in other namespaces, before the Agent is deleted
+const agentFinalizer = "azdevops.gofound.nl/finalizer"
+
+// reconcileRBAC ensures the ServiceAccount of the agents and the Roles and
+// RoleBindings in the target namespaces match the rbac settings. Roles and
+// RoleBindings that are no longer declared are removed.
+func (r *AgentReconciler) reconcileRBAC(ctx context.Context, m *azdevopsv1alpha1.Agent) error {
+	logger := log.FromContext(ctx)
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure ServiceAccount exists while rbac is configured
+	if m.Spec.RBAC != nil {
+		if _, err := r.apply(ctx, r.serviceAccountForAgent(m)); err != nil {
+			return err
+		}
+	} else {
+		foundSa := corev1.ServiceAccount{}
+		err := r.Get(ctx, types.NamespacedName{Name: m.Name, Namespace: m.Namespace}, &foundSa)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		} else if err == nil && metav1.IsControlledBy(&foundSa, m) {
+			logger.Info("Deleting ServiceAccount", "ServiceAccount.Namespace", foundSa.Namespace, "ServiceAccount.Name", foundSa.Name)
+			if err = r.Delete(ctx, &foundSa); err != nil {
+				return err
+			}
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure Roles and RoleBindings in the target namespaces
+	roles := r.rolesForAgent(m)
+	bindings := r.roleBindingsForAgent(m)
+
+	for i := range roles {
+		if _, err := r.apply(ctx, &roles[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := range bindings {
+		if err := r.applyRoleBinding(ctx, &bindings[i]); err != nil {
+			return err
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Remove Roles and RoleBindings of namespaces that are no longer declared
+	return r.pruneRBAC(ctx, m, roles, bindings)
+}
+
+// applyRoleBinding applies a RoleBinding, a binding that refers to another
+// role is replaced as the role reference is immutable
+func (r *AgentReconciler) applyRoleBinding(ctx context.Context, binding *rbacv1.RoleBinding) error {
+	found := rbacv1.RoleBinding{}
+	err := r.Get(ctx, client.ObjectKeyFromObject(binding), &found)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	} else if err == nil && !reflect.DeepEqual(binding.RoleRef, found.RoleRef) {
+		log.FromContext(ctx).Info("Replacing RoleBinding", "RoleBinding.Namespace", found.Namespace, "RoleBinding.Name", found.Name)
+		if err = r.Delete(ctx, &found); err != nil {
+			return err
+		}
+	}
+	_, err = r.apply(ctx, binding)
+	return err
+}
+
+// cleanupRBAC removes all Roles and RoleBindings of the Agent in the
+// target namespaces
+func (r *AgentReconciler) cleanupRBAC(ctx context.Context, m *azdevopsv1alpha1.Agent) error {
+	return r.pruneRBAC(ctx, m, nil, nil)
+}
+
+// pruneRBAC deletes the Roles and RoleBindings of the Agent that are not
+// part of the given desired Roles and RoleBindings
+func (r *AgentReconciler) pruneRBAC(ctx context.Context, m *azdevopsv1alpha1.Agent, roles []rbacv1.Role, bindings []rbacv1.RoleBinding) error {
+	logger := log.FromContext(ctx)
+	selector := client.MatchingLabels(rbacLabelsForAgent(m))
+
+	desired := map[types.NamespacedName]bool{}
+	for _, role := range roles {
+		desired[types.NamespacedName{Name: role.Name, Namespace: role.Namespace}] = true
+	}
+	foundRoles := &rbacv1.RoleList{}
+	if err := r.List(ctx, foundRoles, selector); err != nil {
+		return err
+	}
+	for i := range foundRoles.Items {
+		role := &foundRoles.Items[i]
+		if !desired[types.NamespacedName{Name: role.Name, Namespace: role.Namespace}] {
+			logger.Info("Deleting Role", "Role.Namespace", role.Namespace, "Role.Name", role.Name)
+			if err := r.Delete(ctx, role); client.IgnoreNotFound(err) != nil {
+				return err
+			}
+		}
+	}
+
+	desired = map[types.NamespacedName]bool{}
+	for _, binding := range bindings {
+		desired[types.NamespacedName{Name: binding.Name, Namespace: binding.Namespace}] = true
+	}
+	foundBindings := &rbacv1.RoleBindingList{}
+	if err := r.List(ctx, foundBindings, selector); err != nil {
+		return err
+	}
+	for i := range foundBindings.Items {
+		binding := &foundBindings.Items[i]
+		if !desired[types.NamespacedName{Name: binding.Name, Namespace: binding.Namespace}] {
+			logger.Info("Deleting RoleBinding", "RoleBinding.Namespace", binding.Namespace, "RoleBinding.Name", binding.Name)
+			if err := r.Delete(ctx, binding); client.IgnoreNotFound(err) != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkRBAC verifies the target namespaces and ClusterRoles are allowed by
+// the operator configuration, the operator can grant permissions it holds
+// itself so an Agent must not be able to choose them freely
+func (r *AgentReconciler) checkRBAC(m *azdevopsv1alpha1.Agent) metav1.Condition {
+	for _, ns := range m.Spec.RBAC.Namespaces {
+		reason, message := r.checkTarget(m, ns.Name, ns.ClusterRoles)
+		if reason == "" {
+			for _, rule := range ns.Rules {
+				if !ruleAllowed(rule, r.defaults().AllowedRBACRules) {
+					reason = "RuleNotAllowed"
+					message = fmt.Sprintf("rule %s in namespace %s is not covered by the allowed rbac rules", rule.String(), ns.Name)
+					break
+				}
+			}
+		}
+		if reason != "" {
+			return metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionRBACAllowed,
+				Status:  metav1.ConditionFalse,
+				Reason:  reason,
+				Message: message,
+			}
+		}
+	}
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionRBACAllowed,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Allowed",
+		Message: "the target namespaces, rules and ClusterRoles are allowed",
+	}
+}
+
+// checkTarget returns the reason and message why the Agent can not be
+// granted the ClusterRoles in namespace, the reason is empty when allowed
+func (r *AgentReconciler) checkTarget(m *azdevopsv1alpha1.Agent, namespace string, clusterRoles []string) (string, string) {
+	if !r.namespaceWatched(namespace) {
+		return "NamespaceNotWatched", fmt.Sprintf("namespace %s is not watched by the operator", namespace)
+	}
+	if !r.namespaceAllowed(m, namespace) {
+		return "NamespaceNotAllowed", fmt.Sprintf("namespace %s is not one of the allowed rbac namespaces", namespace)
+	}
+	for _, clusterRole := range clusterRoles {
+		if !r.clusterRoleAllowed(clusterRole) {
+			return "ClusterRoleNotAllowed", fmt.Sprintf("ClusterRole %s is not one of the allowed ClusterRoles", clusterRole)
+		}
+	}
+	return "", ""
+}
+
+// namespaceAllowed returns true if the Agent can be granted access to the
+// namespace, its own namespace is always allowed
+func (r *AgentReconciler) namespaceAllowed(m *azdevopsv1alpha1.Agent, namespace string) bool {
+	if namespace == m.Namespace {
+		return true
+	}
+	for _, allowed := range r.defaults().AllowedRBACNamespaces {
+		if namespace == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceWatched returns true if the cache of the operator serves the
+// namespace, the operator has no access to namespaces it does not watch
+func (r *AgentReconciler) namespaceWatched(namespace string) bool {
+	if len(r.WatchNamespaces) == 0 {
+		return true
+	}
+	for _, watched := range r.WatchNamespaces {
+		if namespace == watched {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleAllowed returns true if every permission of rule is granted by one of
+// the allowed rules, a wildcard is only covered by a wildcard. Roles can not
+// grant non-resource URLs.
+func ruleAllowed(rule rbacv1.PolicyRule, allowed []rbacv1.PolicyRule) bool {
+	if len(rule.NonResourceURLs) > 0 {
+		return false
+	}
+	names := rule.ResourceNames
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	for _, group := range rule.APIGroups {
+		for _, resource := range rule.Resources {
+			for _, verb := range rule.Verbs {
+				for _, name := range names {
+					if !permissionAllowed(allowed, group, resource, verb, name) {
+						return false
+					}
+				}
+			}
+		}
+	}
+	return true
+}
+
+// permissionAllowed returns true if one of the allowed rules grants verb on
+// the resource, an empty name stands for all resources of the kind
+func permissionAllowed(allowed []rbacv1.PolicyRule, group, resource, verb, name string) bool {
+	for _, rule := range allowed {
+		if !matchesRuleValue(rule.APIGroups, group) || !matchesRuleValue(rule.Resources, resource) || !matchesRuleValue(rule.Verbs, verb) {
+			continue
+		}
+		if len(rule.ResourceNames) == 0 || (name != "" && matchesRuleValue(rule.ResourceNames, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesRuleValue returns true if values contain value or the wildcard
+func matchesRuleValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value || v == rbacv1.ResourceAll {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterRoleAllowed returns true if the ClusterRole can be bound
+func (r *AgentReconciler) clusterRoleAllowed(name string) bool {
+	for _, allowed := range r.defaults().AllowedClusterRoles {
+		if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *AgentReconciler) serviceAccountForAgent(m *azdevopsv1alpha1.Agent) *corev1.ServiceAccount {
+	sa := corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:    labelsForAgent(m.Name),
+			Name:      m.Name,
+			Namespace: m.Namespace,
+		},
+	}
+	// Set Agent instance as the owner and controller
+	ctrl.SetControllerReference(m, &sa, r.Scheme)
+	return &sa
+}
+
+func (r *AgentReconciler) rolesForAgent(m *azdevopsv1alpha1.Agent) []rbacv1.Role {
+	roles := []rbacv1.Role{}
+	if m.Spec.RBAC == nil {
+		return roles
+	}
+	for _, ns := range m.Spec.RBAC.Namespaces {
+		if len(ns.Rules) == 0 {
+			continue
+		}
+		roles = append(roles, rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:    rbacLabelsForAgent(m),
+				Name:      rbacNameForAgent(m),
+				Namespace: ns.Name,
+			},
+			Rules: ns.Rules,
+		})
+	}
+	return roles
+}
+
+func (r *AgentReconciler) roleBindingsForAgent(m *azdevopsv1alpha1.Agent) []rbacv1.RoleBinding {
+	bindings := []rbacv1.RoleBinding{}
+	if m.Spec.RBAC == nil {
+		return bindings
+	}
+	subjects := []rbacv1.Subject{{
+		Kind:      rbacv1.ServiceAccountKind,
+		Name:      m.Name,
+		Namespace: m.Namespace,
+	}}
+	for _, ns := range m.Spec.RBAC.Namespaces {
+		if len(ns.Rules) > 0 {
+			bindings = append(bindings, rbacv1.RoleBinding{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:    rbacLabelsForAgent(m),
+					Name:      rbacNameForAgent(m),
+					Namespace: ns.Name,
+				},
+				RoleRef: rbacv1.RoleRef{
+					APIGroup: rbacv1.GroupName,
+					Kind:     "Role",
+					Name:     rbacNameForAgent(m),
+				},
+				Subjects: subjects,
+			})
+		}
+		for _, clusterRole := range ns.ClusterRoles {
+			bindings = append(bindings, rbacv1.RoleBinding{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:    rbacLabelsForAgent(m),
+					Name:      fmt.Sprintf("%s-%s", rbacNameForAgent(m), clusterRole),
+					Namespace: ns.Name,
+				},
+				RoleRef: rbacv1.RoleRef{
+					APIGroup: rbacv1.GroupName,
+					Kind:     "ClusterRole",
+					Name:     clusterRole,
+				},
+				Subjects: subjects,
+			})
+		}
+	}
+	return bindings
+}
+
+// rbacNameForAgent is the name of the Roles and RoleBindings in the target
+// namespaces, it contains the Agent namespace as Agents with the same name
+// in different namespaces can target the same namespace
+func rbacNameForAgent(m *azdevopsv1alpha1.Agent) string {
+	return fmt.Sprintf("azdevops-agent-%s-%s", m.Namespace, m.Name)
+}
+
+// rbacLabelsForAgent selects the Roles and RoleBindings of the Agent
+// across all target namespaces
+func rbacLabelsForAgent(m *azdevopsv1alpha1.Agent) map[string]string {
+	ls := labelsForAgent(m.Name)
+	ls["agent_namespace"] = m.Namespace
+	return ls
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	configv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/config/v1alpha1"
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/azdevops-agent-operator/pkg/acr"
+)
+
+const (
+	// dockerConfigPath is the DOCKER_CONFIG directory holding config.json
+	dockerConfigPath = "/opt/azp-docker"
+	// dockerConfigExpiresAnnotation records when the first registry token
+	// of a generated config.json expires
+	dockerConfigExpiresAnnotation = "azdevops.gofound.nl/docker-config-expires"
+	// dockerConfigRegistriesAnnotation records the registries of a
+	// generated config.json
+	dockerConfigRegistriesAnnotation = "azdevops.gofound.nl/docker-config-registries"
+	// dockerConfigRefreshBefore is how long before they expire the registry
+	// tokens are refreshed, the Agents are reconciled every minute
+	dockerConfigRefreshBefore = time.Hour
+)
+
+// dockerAuth is a registry login of a docker config.json
+type dockerAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+// reconcileDockerConfig validates the docker config settings, checks the
+// referenced Secret and refreshes the generated config.json before the
+// registry tokens expire. A generated config.json is removed when the
+// Agent no longer logs in to Azure Container Registries.
+func (r *AgentReconciler) reconcileDockerConfig(ctx context.Context, m *azdevopsv1alpha1.Agent, now time.Time) (metav1.Condition, error) {
+	c := m.Spec.DockerConfig
+	if c != nil {
+		if err := validateDockerConfig(c); err != nil {
+			return metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionDockerConfigReady,
+				Status:  metav1.ConditionFalse,
+				Reason:  "Invalid",
+				Message: err.Error(),
+			}, nil
+		}
+	}
+
+	if c == nil || c.ACR == nil {
+		found := corev1.Secret{}
+		err := r.Get(ctx, types.NamespacedName{Name: dockerConfigNameForAgent(m), Namespace: m.Namespace}, &found)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return metav1.Condition{}, err
+		} else if err == nil && metav1.IsControlledBy(&found, m) {
+			log.FromContext(ctx).Info("Deleting Secret", "Secret.Namespace", found.Namespace, "Secret.Name", found.Name)
+			if err = r.Delete(ctx, &found); err != nil {
+				return metav1.Condition{}, err
+			}
+		}
+	}
+	if c == nil {
+		return metav1.Condition{}, nil
+	}
+
+	if c.SecretName != "" {
+		err := r.Get(ctx, types.NamespacedName{Name: c.SecretName, Namespace: m.Namespace}, &corev1.Secret{})
+		if err != nil && apierrors.IsNotFound(err) {
+			return metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionDockerConfigReady,
+				Status:  metav1.ConditionFalse,
+				Reason:  "SecretNotFound",
+				Message: fmt.Sprintf("Secret %s not found", c.SecretName),
+			}, nil
+		} else if err != nil {
+			return metav1.Condition{}, err
+		}
+		return metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionDockerConfigReady,
+			Status:  metav1.ConditionTrue,
+			Reason:  "Mounted",
+			Message: fmt.Sprintf("config.json is read from Secret %s", c.SecretName),
+		}, nil
+	}
+	return r.refreshRegistryTokens(ctx, m, now)
+}
+
+// refreshRegistryTokens generates the config.json with refresh tokens of
+// the Azure Container Registries, the tokens are kept until they almost
+// expire or the registries change
+func (r *AgentReconciler) refreshRegistryTokens(ctx context.Context, m *azdevopsv1alpha1.Agent, now time.Time) (metav1.Condition, error) {
+	c := m.Spec.DockerConfig.ACR
+	registries := strings.Join(c.Registries, ",")
+
+	found := corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: dockerConfigNameForAgent(m), Namespace: m.Namespace}, &found)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return metav1.Condition{}, err
+	} else if err == nil && found.Annotations[dockerConfigRegistriesAnnotation] == registries {
+		expires, err := time.Parse(time.RFC3339, found.Annotations[dockerConfigExpiresAnnotation])
+		if err == nil && now.Add(dockerConfigRefreshBefore).Before(expires) {
+			return registryTokensValid(expires), nil
+		}
+	}
+
+	// the Azure AD token of the operator is only sent to the registries the
+	// operator configuration allows for the namespace of the Agent
+	defaults := r.defaults()
+	allowed := acrRegistriesForNamespace(defaults, m.Namespace)
+	for _, registry := range c.Registries {
+		if !acr.LoginServerAllowed(registry, allowed) {
+			return metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionDockerConfigReady,
+				Status:  metav1.ConditionFalse,
+				Reason:  "LoginServerNotAllowed",
+				Message: fmt.Sprintf("%s is not an Azure Container Registry the operator allows for namespace %s", registry, m.Namespace),
+			}, nil
+		}
+	}
+
+	identity := acr.WorkloadIdentityFromEnv()
+	if defaults.ACRClientID != "" {
+		identity.ClientID = defaults.ACRClientID
+	}
+	if defaults.ACRTenantID != "" {
+		identity.TenantID = defaults.ACRTenantID
+	}
+	client, err := acr.NewClient(identity)
+	if err != nil {
+		return metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionDockerConfigReady,
+			Status:  metav1.ConditionFalse,
+			Reason:  "NoWorkloadIdentity",
+			Message: err.Error(),
+		}, nil
+	}
+	client.AllowedLoginServers = allowed
+	accessToken, err := client.AccessToken(ctx)
+	if err != nil {
+		return metav1.Condition{}, err
+	}
+	auths := map[string]dockerAuth{}
+	var expires time.Time
+	for _, registry := range c.Registries {
+		token, tokenExpires, err := client.RefreshToken(ctx, registry, accessToken)
+		if err != nil {
+			return metav1.Condition{}, err
+		}
+		auths[registry] = dockerAuth{
+			Username: acr.Username,
+			Password: token,
+			Auth:     base64.StdEncoding.EncodeToString([]byte(acr.Username + ":" + token)),
+		}
+		if expires.IsZero() || tokenExpires.Before(expires) {
+			expires = tokenExpires
+		}
+	}
+	config, err := json.Marshal(map[string]interface{}{"auths": auths})
+	if err != nil {
+		return metav1.Condition{}, err
+	}
+
+	sec := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:    labelsForAgent(m.Name),
+			Name:      dockerConfigNameForAgent(m),
+			Namespace: m.Namespace,
+			Annotations: map[string]string{
+				dockerConfigExpiresAnnotation:    expires.UTC().Format(time.RFC3339),
+				dockerConfigRegistriesAnnotation: registries,
+			},
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: config},
+	}
+	// Set Agent instance as the owner and controller
+	ctrl.SetControllerReference(m, &sec, r.Scheme)
+	if _, err = r.apply(ctx, &sec); err != nil {
+		return metav1.Condition{}, err
+	}
+	return registryTokensValid(expires), nil
+}
+
+func registryTokensValid(expires time.Time) metav1.Condition {
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionDockerConfigReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  "TokensValid",
+		Message: fmt.Sprintf("registry tokens are valid until %s", expires.UTC().Format(time.RFC3339)),
+	}
+}
+
+// validateDockerConfig checks that the config.json has exactly one source
+func validateDockerConfig(c *azdevopsv1alpha1.DockerConfig) error {
+	if (c.SecretName == "") == (c.ACR == nil) {
+		return errors.New("dockerConfig needs exactly one of secretName and acr")
+	}
+	return nil
+}
+
+// dockerConfigForAgent returns the volume and mount of the config.json and
+// the DOCKER_CONFIG pointing docker at it, the mount is not a subpath so a
+// refreshed config.json reaches running pods
+func dockerConfigForAgent(m *azdevopsv1alpha1.Agent) ([]corev1.Volume, []corev1.VolumeMount, []corev1.EnvVar) {
+	c := m.Spec.DockerConfig
+	if c == nil || validateDockerConfig(c) != nil {
+		return nil, nil, nil
+	}
+	secretName := c.SecretName
+	if c.ACR != nil {
+		secretName = dockerConfigNameForAgent(m)
+	}
+	volumes := []corev1.Volume{{
+		Name: "docker-config",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: secretName,
+				Items:      []corev1.KeyToPath{{Key: corev1.DockerConfigJsonKey, Path: "config.json"}},
+			},
+		},
+	}}
+	mounts := []corev1.VolumeMount{{Name: "docker-config", MountPath: dockerConfigPath, ReadOnly: true}}
+	env := []corev1.EnvVar{{Name: "DOCKER_CONFIG", Value: dockerConfigPath}}
+	return volumes, mounts, env
+}
+
+// imagePullSecretsForAgent returns the image pull secrets of the Agent, the
+// generated config.json pulls images from the Azure Container Registries
+func imagePullSecretsForAgent(m *azdevopsv1alpha1.Agent) []corev1.LocalObjectReference {
+	secrets := append([]corev1.LocalObjectReference{}, m.Spec.ImagePullSecrets...)
+	if c := m.Spec.DockerConfig; c != nil && c.ACR != nil && validateDockerConfig(c) == nil {
+		secrets = append(secrets, corev1.LocalObjectReference{Name: dockerConfigNameForAgent(m)})
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+	return secrets
+}
+
+// dockerConfigNameForAgent is the name of the generated config.json Secret
+func dockerConfigNameForAgent(m *azdevopsv1alpha1.Agent) string {
+	return m.Name + "-docker-config"
+}
+
+// acrRegistriesForNamespace returns the registries the operator obtains
+// tokens for on behalf of the Agents in namespace
+func acrRegistriesForNamespace(defaults configv1alpha1.AgentDefaults, namespace string) []string {
+	var registries []string
+	for _, grant := range defaults.AllowedACRRegistries {
+		granted := len(grant.Namespaces) == 0
+		for _, allowed := range grant.Namespaces {
+			if namespace == allowed {
+				granted = true
+			}
+		}
+		if granted {
+			registries = append(registries, grant.Registries...)
+		}
+	}
+	return registries
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/azdevops-agent-operator/pkg/azdevops"
+)
+
+const (
+	// canaryLabel marks the pods of the canary agents, the stable
+	// Deployment does not adopt them as they are owned by the canary
+	// ReplicaSet
+	canaryLabel = "azdevops.gofound.nl/rollout"
+	// canaryLabelValue is the value of canaryLabel on canary pods
+	canaryLabelValue = "canary"
+
+	defaultCanaryAgents       int32 = 1
+	defaultRolloutJobs        int32 = 3
+	defaultRolloutSuccessRate int32 = 90
+	defaultRolloutTimeout           = time.Hour
+)
+
+// reconcileRollout advances the canary rollout of the image of m and
+// returns the rollout status, whose stable image the stable agents run.
+// A changed image first runs on the canary agents, it is promoted once
+// enough canary jobs succeeded and rolled back when too many failed or the
+// canaries did not complete enough jobs in time. found is the stable
+// Deployment, nil when it does not exist yet.
+func (r *AgentReconciler) reconcileRollout(ctx context.Context, m *azdevopsv1alpha1.Agent, found *appsv1.Deployment, now time.Time) (*azdevopsv1alpha1.RolloutStatus, error) {
+	logger := log.FromContext(ctx)
+	desired := m.Spec.Image
+	if desired == "" {
+		desired = defaultAgentImage
+	}
+
+	st := m.Status.Rollout.DeepCopy()
+	if st == nil {
+		st = &azdevopsv1alpha1.RolloutStatus{Phase: azdevopsv1alpha1.RolloutStable, StableImage: desired}
+		if found != nil && len(found.Spec.Template.Spec.Containers) > 0 {
+			st.StableImage = found.Spec.Template.Spec.Containers[0].Image
+		}
+	}
+
+	switch st.Phase {
+	case azdevopsv1alpha1.RolloutProgressing:
+		if desired == st.StableImage {
+			setRolloutPhase(st, azdevopsv1alpha1.RolloutStable, fmt.Sprintf("rollout of %s aborted", st.CanaryImage))
+		} else if desired != st.CanaryImage {
+			startRollout(st, desired, now)
+		} else if err := r.evaluateCanaries(ctx, m, st, now); err != nil {
+			// keep the canaries running until Azure DevOps is available
+			logger.Error(err, "Failed to evaluate canary jobs", "Agent.Namespace", m.Namespace, "Agent.Name", m.Name)
+			recordError(m.Namespace, m.Name, "rollout")
+		}
+	case azdevopsv1alpha1.RolloutRolledBack:
+		if desired == st.StableImage {
+			setRolloutPhase(st, azdevopsv1alpha1.RolloutStable, "")
+		} else if desired != st.CanaryImage {
+			startRollout(st, desired, now)
+		}
+	default:
+		if desired != st.StableImage {
+			if found == nil {
+				// no agents run yet, there is nothing to protect
+				st.StableImage = desired
+			} else {
+				startRollout(st, desired, now)
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(st, m.Status.Rollout) {
+		if m.Status.Rollout == nil || m.Status.Rollout.Phase != st.Phase || m.Status.Rollout.CanaryImage != st.CanaryImage {
+			logger.Info("Rollout phase changed", "Agent.Namespace", m.Namespace, "Agent.Name", m.Name, "Phase", st.Phase, "Image", st.CanaryImage, "Message", st.Message)
+		}
+		m.Status.Rollout = st
+		if err := r.updateStatus(ctx, m); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// startRollout starts canaries with image
+func startRollout(st *azdevopsv1alpha1.RolloutStatus, image string, now time.Time) {
+	start := metav1.NewTime(now)
+	st.CanaryImage = image
+	st.StartTime = &start
+	st.SucceededJobs = 0
+	st.FailedJobs = 0
+	st.LastJobFinishTime = nil
+	setRolloutPhase(st, azdevopsv1alpha1.RolloutProgressing, fmt.Sprintf("canaries run %s", image))
+}
+
+func setRolloutPhase(st *azdevopsv1alpha1.RolloutStatus, phase azdevopsv1alpha1.RolloutPhase, message string) {
+	st.Phase = phase
+	st.Message = message
+}
+
+// evaluateCanaries counts the jobs the canaries completed since the last
+// evaluation and promotes or rolls back the canary image. The finish time of
+// the last counted job is kept in the rollout status, so every job is
+// counted once however many jobs the pool completes in between.
+func (r *AgentReconciler) evaluateCanaries(ctx context.Context, m *azdevopsv1alpha1.Agent, st *azdevopsv1alpha1.RolloutStatus, now time.Time) error {
+	jobs, successRate, timeout := rolloutPolicy(m)
+
+	canaryName, err := r.canaryNamePattern(ctx, m)
+	if err != nil {
+		return err
+	}
+	ado := azdevops.NewClient(m.Spec.Pool.URL, m.Spec.Pool.Token)
+	pool, err := ado.GetPoolByName(ctx, m.Spec.Pool.PoolName)
+	if err != nil {
+		return err
+	}
+	requests, err := ado.ListJobRequests(ctx, pool.ID, completedJobRequests)
+	if err != nil {
+		return err
+	}
+
+	since := st.StartTime.Time
+	if st.LastJobFinishTime != nil {
+		since = st.LastJobFinishTime.Time
+	}
+	last := since
+	for _, req := range requests {
+		if canaryName == nil || req.FinishTime == nil || req.ReservedAgent == nil ||
+			!req.FinishTime.After(since) || !canaryName.MatchString(req.ReservedAgent.Name) {
+			continue
+		}
+		switch req.Result {
+		case "succeeded", "succeededWithIssues":
+			st.SucceededJobs++
+		case "failed", "abandoned":
+			st.FailedJobs++
+		}
+		if req.FinishTime.After(last) {
+			last = *req.FinishTime
+		}
+	}
+	if last.After(since) {
+		st.LastJobFinishTime = &metav1.MicroTime{Time: last}
+	}
+	succeeded, failed := st.SucceededJobs, st.FailedJobs
+
+	total := succeeded + failed
+	switch {
+	case total >= jobs && succeeded*100 >= successRate*total:
+		setRolloutPhase(st, azdevopsv1alpha1.RolloutStable,
+			fmt.Sprintf("%s promoted, %d of %d canary jobs succeeded", st.CanaryImage, succeeded, total))
+		st.StableImage = st.CanaryImage
+	case total >= jobs:
+		setRolloutPhase(st, azdevopsv1alpha1.RolloutRolledBack,
+			fmt.Sprintf("%s rolled back, only %d of %d canary jobs succeeded", st.CanaryImage, succeeded, total))
+	case now.After(st.StartTime.Add(timeout)):
+		setRolloutPhase(st, azdevopsv1alpha1.RolloutRolledBack,
+			fmt.Sprintf("%s rolled back, the canaries completed %d of %d jobs within %s", st.CanaryImage, total, jobs, timeout))
+	}
+	return nil
+}
+
+// rolloutPolicy returns the jobs, success rate and timeout of the rollout
+// of m with the defaults applied
+func rolloutPolicy(m *azdevopsv1alpha1.Agent) (int32, int32, time.Duration) {
+	jobs, successRate, timeout := defaultRolloutJobs, defaultRolloutSuccessRate, defaultRolloutTimeout
+	if m.Spec.Rollout.Jobs > 0 {
+		jobs = m.Spec.Rollout.Jobs
+	}
+	if m.Spec.Rollout.SuccessRate > 0 {
+		successRate = m.Spec.Rollout.SuccessRate
+	}
+	if m.Spec.Rollout.Timeout != nil {
+		timeout = m.Spec.Rollout.Timeout.Duration
+	}
+	return jobs, successRate, timeout
+}
+
+// reconcileCanary applies the canary Deployment while a rollout progresses
+// and removes it otherwise
+func (r *AgentReconciler) reconcileCanary(ctx context.Context, m *azdevopsv1alpha1.Agent, st *azdevopsv1alpha1.RolloutStatus) error {
+	if st != nil && st.Phase == azdevopsv1alpha1.RolloutProgressing {
+		op, err := r.apply(ctx, r.canaryDeploymentForAgent(m, st.CanaryImage))
+		if err == nil && op != "" {
+			recordWrite(m.Namespace, m.Name, "Deployment", op)
+		}
+		return err
+	}
+
+	found := appsv1.Deployment{}
+	err := r.Get(ctx, types.NamespacedName{Name: canaryNameForAgent(m), Namespace: m.Namespace}, &found)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !metav1.IsControlledBy(&found, m) {
+		return nil
+	}
+	log.FromContext(ctx).Info("Deleting canary Deployment", "Deployment.Namespace", found.Namespace, "Deployment.Name", found.Name)
+	return r.Delete(ctx, &found)
+}
+
+// canaryDeploymentForAgent runs the canary agents with image, their pods
+// carry the canary label on top of the agent labels so the disruption
+// budget and network policy of the Agent apply to them as well
+func (r *AgentReconciler) canaryDeploymentForAgent(m *azdevopsv1alpha1.Agent, image string) *appsv1.Deployment {
+	canary := m.DeepCopy()
+	canary.Spec.Image = image
+	dep := r.deploymentForAgent(canary)
+
+	replicas := defaultCanaryAgents
+	if m.Spec.Rollout != nil && m.Spec.Rollout.CanaryAgents > 0 {
+		replicas = m.Spec.Rollout.CanaryAgents
+	}
+	dep.Name = canaryNameForAgent(m)
+	dep.Spec.Replicas = &replicas
+	dep.Spec.Selector = &metav1.LabelSelector{MatchLabels: canaryLabelsForAgent(m.Name)}
+	dep.Spec.Template.Labels = canaryLabelsForAgent(m.Name)
+	return dep
+}
+
+// canaryNamePattern matches the names the canary agents of m register with,
+// nil when no canary pods were created yet. An Agent named like the canary
+// Deployment registers agents with the same prefix, so the names are
+// matched on the pod template hashes of the canary ReplicaSets as well.
+func (r *AgentReconciler) canaryNamePattern(ctx context.Context, m *azdevopsv1alpha1.Agent) (*regexp.Regexp, error) {
+	replicaSets := appsv1.ReplicaSetList{}
+	if err := r.List(ctx, &replicaSets, client.InNamespace(m.Namespace), client.MatchingLabels(canaryLabelsForAgent(m.Name))); err != nil {
+		return nil, err
+	}
+	hashes := []string{}
+	for _, rs := range replicaSets.Items {
+		if hash := rs.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; hash != "" {
+			hashes = append(hashes, regexp.QuoteMeta(hash))
+		}
+	}
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	return regexp.MustCompile("^" + regexp.QuoteMeta(canaryNameForAgent(m)) + "-(" + strings.Join(hashes, "|") + ")-[a-z0-9]{5}$"), nil
+}
+
+// canaryNameForAgent is the name of the canary Deployment
+func canaryNameForAgent(m *azdevopsv1alpha1.Agent) string {
+	return m.Name + "-canary"
+}
+
+func canaryLabelsForAgent(name string) map[string]string {
+	ls := labelsForAgent(name)
+	ls[canaryLabel] = canaryLabelValue
+	return ls
+}
+
+// isCanary returns true if pod runs a canary agent
+func isCanary(pod *corev1.Pod) bool {
+	return pod.Labels[canaryLabel] == canaryLabelValue
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/azdevops-agent-operator/pkg/azdevops"
+)
+
+const (
+	// podDeletionCostAnnotation makes the ReplicaSet controller remove
+	// the annotated pods first when the Deployment is scaled down
+	podDeletionCostAnnotation = "controller.kubernetes.io/pod-deletion-cost"
+	// scaleDownDeletionCost is the deletion cost of idle agents selected for removal
+	scaleDownDeletionCost = "-1000"
+	// defaultGracePeriodSeconds gives busy agents an hour to finish their job
+	defaultGracePeriodSeconds int64 = 3600
+	// waitForJobScript blocks the preStop hook while the agent runs a job
+	waitForJobScript = "while pgrep -f Agent.Worker > /dev/null; do sleep 5; done"
+)
+
+// scaleDownAgents selects up to count idle agents for removal. Selected
+// agents are first disabled in Azure DevOps so no new job lands on them,
+// only on a next pass, when they are still idle, their pods are marked to be
+// deleted first. It returns the replicas the Deployment can safely be
+// reduced to.
+func (r *AgentReconciler) scaleDownAgents(ctx context.Context, m *azdevopsv1alpha1.Agent, replicas, count int32) (int32, error) {
+	logger := log.FromContext(ctx)
+
+	pods, err := r.agentPods(ctx, m)
+	if err != nil {
+		return replicas, err
+	}
+
+	ado := azdevops.NewClient(m.Spec.Pool.URL, m.Spec.Pool.Token)
+	pool, err := ado.GetPoolByName(ctx, m.Spec.Pool.PoolName)
+	if err != nil {
+		return replicas, err
+	}
+	registered, err := registeredAgents(ctx, ado, pool.ID)
+	if err != nil {
+		return replicas, err
+	}
+
+	// pods of agents that are not registered are removed first, followed
+	// by agents that are already disabled, busy agents are never selected
+	candidates := []corev1.Pod{}
+	for _, pod := range pods {
+		// the canaries are removed with the canary Deployment
+		if pod.DeletionTimestamp != nil || isCanary(&pod) {
+			continue
+		}
+		if a, ok := registered[agentNameForPod(&pod)]; ok && a.Busy() {
+			continue
+		}
+		candidates = append(candidates, pod)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return removalRank(registered, &candidates[i]) < removalRank(registered, &candidates[j])
+	})
+
+	var removable int32
+	for i := range candidates {
+		if int32(i) >= count {
+			break
+		}
+		pod := &candidates[i]
+		if a, ok := registered[agentNameForPod(pod)]; ok && a.Enabled {
+			logger.Info("Disabling idle agent before removal", "Pod.Name", pod.Name, "Agent.ID", a.ID)
+			if err := ado.SetAgentEnabled(ctx, pool.ID, a.ID, false); err != nil {
+				return replicas, err
+			}
+		} else {
+			removable++
+		}
+		if pod.Annotations[podDeletionCostAnnotation] != scaleDownDeletionCost {
+			patch := client.MergeFrom(pod.DeepCopy())
+			if pod.Annotations == nil {
+				pod.Annotations = map[string]string{}
+			}
+			pod.Annotations[podDeletionCostAnnotation] = scaleDownDeletionCost
+			if err := r.Patch(ctx, pod, patch); err != nil {
+				return replicas, err
+			}
+		}
+	}
+
+	return replicas - removable, nil
+}
+
+// releaseAgents enables the agents that were disabled for a scale down
+// that is no longer needed, for example because the size was increased
+// again before the pods were removed.
+func (r *AgentReconciler) releaseAgents(ctx context.Context, m *azdevopsv1alpha1.Agent) error {
+	logger := log.FromContext(ctx)
+
+	pods, err := r.agentPods(ctx, m)
+	if err != nil {
+		return err
+	}
+	selected := []corev1.Pod{}
+	for _, pod := range pods {
+		if pod.DeletionTimestamp == nil && !isCanary(&pod) && pod.Annotations[podDeletionCostAnnotation] == scaleDownDeletionCost {
+			selected = append(selected, pod)
+		}
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+
+	ado := azdevops.NewClient(m.Spec.Pool.URL, m.Spec.Pool.Token)
+	pool, err := ado.GetPoolByName(ctx, m.Spec.Pool.PoolName)
+	if err != nil {
+		return err
+	}
+	registered, err := registeredAgents(ctx, ado, pool.ID)
+	if err != nil {
+		return err
+	}
+
+	for i := range selected {
+		pod := &selected[i]
+		if a, ok := registered[agentNameForPod(pod)]; ok && !a.Enabled {
+			logger.Info("Enabling agent that is no longer scaled down", "Pod.Name", pod.Name, "Agent.ID", a.ID)
+			if err := ado.SetAgentEnabled(ctx, pool.ID, a.ID, true); err != nil {
+				return err
+			}
+		}
+		patch := client.MergeFrom(pod.DeepCopy())
+		delete(pod.Annotations, podDeletionCostAnnotation)
+		if err := r.Patch(ctx, pod, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// agentPods returns the pods that run the agents of m
+func (r *AgentReconciler) agentPods(ctx context.Context, m *azdevopsv1alpha1.Agent) ([]corev1.Pod, error) {
+	podList := &corev1.PodList{}
+	listOpts := []client.ListOption{
+		client.InNamespace(m.Namespace),
+		client.MatchingLabels(labelsForAgent(m.Name)),
+	}
+	if err := r.List(ctx, podList, listOpts...); err != nil {
+		return nil, err
+	}
+	return podList.Items, nil
+}
+
+// registeredAgents returns the agents registered in a pool by name
+func registeredAgents(ctx context.Context, ado *azdevops.Client, poolID int) (map[string]azdevops.Agent, error) {
+	agents, err := ado.ListAgents(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	registered := map[string]azdevops.Agent{}
+	for _, a := range agents {
+		registered[a.Name] = a
+	}
+	return registered, nil
+}
+
+// agentNameForPod returns the name the agent in pod registers with, the
+// agent image defaults to the hostname which equals the pod name. The name
+// does not include the namespace, so Agents sharing a pool need names that
+// are unique across namespaces.
+func agentNameForPod(pod *corev1.Pod) string {
+	return pod.Name
+}
+
+// removalRank orders pods by how cheap it is to remove them
+func removalRank(registered map[string]azdevops.Agent, pod *corev1.Pod) int {
+	a, ok := registered[agentNameForPod(pod)]
+	switch {
+	case !ok:
+		return 0
+	case !a.Enabled:
+		return 1
+	default:
+		return 2
+	}
+}
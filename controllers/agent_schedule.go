@@ -0,0 +1,143 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+// scheduleMargin is added to the requeue at a schedule boundary so the
+// Agent is reconciled just after the window opens or closes
+const scheduleMargin = time.Second
+
+// applySchedules sets the Agent size to the size of the active schedule and
+// returns the time until the next window opens or closes, the Agent is only
+// changed in memory
+func applySchedules(m *azdevopsv1alpha1.Agent, now time.Time) (time.Duration, metav1.Condition) {
+	active, next, err := activeSchedule(m.Spec.Schedules, now)
+	if err != nil {
+		return 0, metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionSchedulesValid,
+			Status:  metav1.ConditionFalse,
+			Reason:  "InvalidSchedule",
+			Message: err.Error(),
+		}
+	}
+
+	m.Status.ActiveSchedule = ""
+	if active != nil {
+		m.Spec.Size = active.Size
+		m.Status.ActiveSchedule = active.Name
+	}
+	return next.Sub(now) + scheduleMargin, metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionSchedulesValid,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Valid",
+		Message: fmt.Sprintf("next schedule boundary at %s", next.UTC().Format(time.RFC3339)),
+	}
+}
+
+// schedulesApplied reports if the size of the schedules is applied to the
+// Deployment, the replicas are left alone once another manager owns them
+func schedulesApplied(m *azdevopsv1alpha1.Agent, scaleReplicas bool) metav1.Condition {
+	if !scaleReplicas {
+		return metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionSchedulesApplied,
+			Status:  metav1.ConditionFalse,
+			Reason:  "ReplicasManagedElsewhere",
+			Message: "another manager, like a HorizontalPodAutoscaler, owns the replicas of the Deployment",
+		}
+	}
+	message := fmt.Sprintf("the Deployment is scaled to size %d outside the schedules", m.Spec.Size)
+	if m.Status.ActiveSchedule != "" {
+		message = fmt.Sprintf("the Deployment is scaled to size %d of schedule %s", m.Spec.Size, m.Status.ActiveSchedule)
+	}
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionSchedulesApplied,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Applied",
+		Message: message,
+	}
+}
+
+// activeSchedule returns the first schedule with an open window at now and
+// the first moment after now at which any window opens or closes
+func activeSchedule(schedules []azdevopsv1alpha1.ScheduleConfig, now time.Time) (*azdevopsv1alpha1.ScheduleConfig, time.Time, error) {
+	var active *azdevopsv1alpha1.ScheduleConfig
+	var next time.Time
+
+	for i := range schedules {
+		s := &schedules[i]
+		open, boundary, err := scheduleWindow(s, now)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("schedule %s: %w", s.Name, err)
+		}
+		if open && active == nil {
+			active = s
+		}
+		if next.IsZero() || boundary.Before(next) {
+			next = boundary
+		}
+	}
+	return active, next, nil
+}
+
+// scheduleWindow returns if the window of the schedule is open at now and
+// when it next opens or closes. The window is open when the start expression
+// fired within the last duration.
+func scheduleWindow(s *azdevopsv1alpha1.ScheduleConfig, now time.Time) (bool, time.Time, error) {
+	loc := time.UTC
+	if s.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(s.TimeZone); err != nil {
+			return false, time.Time{}, err
+		}
+	}
+	start, err := cron.ParseStandard(s.Start)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if s.Duration.Duration <= 0 {
+		return false, time.Time{}, fmt.Errorf("duration must be positive")
+	}
+
+	// find the last start within the window, starts can overlap the
+	// previous window which extends it
+	var last time.Time
+	fire := start.Next(now.Add(-s.Duration.Duration).In(loc))
+	for !fire.IsZero() && !fire.After(now) {
+		last = fire
+		fire = start.Next(fire)
+	}
+	if last.IsZero() {
+		if fire.IsZero() {
+			return false, time.Time{}, fmt.Errorf("start %q never fires", s.Start)
+		}
+		return false, fire, nil
+	}
+	end := last.Add(s.Duration.Duration)
+	if !fire.IsZero() && fire.Before(end) {
+		return true, fire, nil
+	}
+	return true, end, nil
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+const (
+	// podSecurityEnforceLabel holds the Pod Security Admission level of a namespace
+	podSecurityEnforceLabel = "pod-security.kubernetes.io/enforce"
+	// agentUserID is the non-root user the agent runs as in the restricted profile
+	agentUserID int64 = 1000
+	// agentInstallPath is where the agent image installs and configures the
+	// agent, the default work directory is below it
+	agentInstallPath = "/azp/agent"
+	// agentHomePath is the home directory of the agent user in the
+	// restricted profile
+	agentHomePath = "/home/agent"
+)
+
+// podSecurityLevels orders the Pod Security Standards from least to most restrictive
+var podSecurityLevels = map[string]int{
+	"privileged": 0,
+	"baseline":   1,
+	"restricted": 2,
+}
+
+// podSecurityLevelForProfile returns the most restrictive Pod Security
+// Standard the pods of a security profile comply with, the image defaults
+// run as root which is allowed up to baseline
+func podSecurityLevelForProfile(profile azdevopsv1alpha1.SecurityProfile) string {
+	switch profile {
+	case azdevopsv1alpha1.SecurityProfileRestricted:
+		return "restricted"
+	case azdevopsv1alpha1.SecurityProfilePrivilegedDind:
+		return "privileged"
+	default:
+		return "baseline"
+	}
+}
+
+// checkPodSecurity compares the security profile of the Agent with the
+// Pod Security Admission level enforced on its namespace
+func (r *AgentReconciler) checkPodSecurity(ctx context.Context, m *azdevopsv1alpha1.Agent) (metav1.Condition, error) {
+	ns := corev1.Namespace{}
+	if err := r.uncachedReader().Get(ctx, types.NamespacedName{Name: m.Namespace}, &ns); err != nil {
+		if errors.IsForbidden(err) {
+			// a namespace scoped operator can not read its namespaces
+			return metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionPodSecurity,
+				Status:  metav1.ConditionUnknown,
+				Reason:  "NamespaceForbidden",
+				Message: fmt.Sprintf("not allowed to read the pod security level of namespace %s", m.Namespace),
+			}, nil
+		}
+		return metav1.Condition{}, err
+	}
+
+	enforced, ok := ns.Labels[podSecurityEnforceLabel]
+	if _, known := podSecurityLevels[enforced]; !ok || !known {
+		enforced = "privileged"
+	}
+	level := podSecurityLevelForProfile(m.Spec.SecurityProfile)
+
+	if podSecurityLevels[level] < podSecurityLevels[enforced] {
+		return metav1.Condition{
+			Type:   azdevopsv1alpha1.ConditionPodSecurity,
+			Status: metav1.ConditionFalse,
+			Reason: "Incompatible",
+			Message: fmt.Sprintf("security profile %q requires pod security level %q but namespace %s enforces %q",
+				m.Spec.SecurityProfile, level, m.Namespace, enforced),
+		}, nil
+	}
+	// host path volumes are only allowed by the privileged level, they
+	// come from the caches or the volumes of the Agent
+	if enforced != "privileged" {
+		for _, volume := range r.deploymentForAgent(m).Spec.Template.Spec.Volumes {
+			if volume.HostPath == nil {
+				continue
+			}
+			return metav1.Condition{
+				Type:   azdevopsv1alpha1.ConditionPodSecurity,
+				Status: metav1.ConditionFalse,
+				Reason: "Incompatible",
+				Message: fmt.Sprintf("host path volume %s requires pod security level \"privileged\" but namespace %s enforces %q",
+					volume.Name, m.Namespace, enforced),
+			}, nil
+		}
+	}
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionPodSecurity,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Compatible",
+		Message: fmt.Sprintf("namespace %s enforces pod security level %q", m.Namespace, enforced),
+	}, nil
+}
+
+// setCondition updates the Agent status when the condition changed
+func (r *AgentReconciler) setCondition(ctx context.Context, m *azdevopsv1alpha1.Agent, condition metav1.Condition) error {
+	current := meta.FindStatusCondition(m.Status.Conditions, condition.Type)
+	if current != nil && current.Status == condition.Status &&
+		current.Reason == condition.Reason && current.Message == condition.Message {
+		return nil
+	}
+	condition.ObservedGeneration = m.Generation
+	meta.SetStatusCondition(&m.Status.Conditions, condition)
+	return r.updateStatus(ctx, m)
+}
+
+// securityContextsForAgent translates the security profile into the pod
+// and container security contexts
+func securityContextsForAgent(m *azdevopsv1alpha1.Agent) (*corev1.PodSecurityContext, *corev1.SecurityContext) {
+	runtimeDefault := &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	no := false
+	yes := true
+	userID := agentUserID
+
+	switch m.Spec.SecurityProfile {
+	case azdevopsv1alpha1.SecurityProfileRestricted:
+		return &corev1.PodSecurityContext{
+			RunAsNonRoot:   &yes,
+			RunAsUser:      &userID,
+			RunAsGroup:     &userID,
+			FSGroup:        &userID,
+			SeccompProfile: runtimeDefault,
+		}, &corev1.SecurityContext{
+			AllowPrivilegeEscalation: &no,
+			ReadOnlyRootFilesystem:   &yes,
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+			},
+		}
+	case azdevopsv1alpha1.SecurityProfileBaseline:
+		return &corev1.PodSecurityContext{
+			SeccompProfile: runtimeDefault,
+		}, &corev1.SecurityContext{
+			AllowPrivilegeEscalation: &no,
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"NET_RAW"},
+			},
+		}
+	case azdevopsv1alpha1.SecurityProfilePrivilegedDind:
+		return nil, &corev1.SecurityContext{
+			Privileged: &yes,
+		}
+	default:
+		return nil, nil
+	}
+}
+
+// writableVolumesForAgent returns the emptyDirs the agent writes to when
+// the restricted profile makes the root filesystem read-only: the agent
+// installation with its work directory, the temp directory and the home
+// directory of the agent user
+func writableVolumesForAgent(m *azdevopsv1alpha1.Agent) ([]corev1.Volume, []corev1.VolumeMount, []corev1.EnvVar) {
+	if m.Spec.SecurityProfile != azdevopsv1alpha1.SecurityProfileRestricted {
+		return nil, nil, nil
+	}
+	paths := map[string]string{
+		"agent": agentInstallPath,
+		"tmp":   "/tmp",
+		"home":  agentHomePath,
+	}
+	names := []string{"agent", "tmp", "home"}
+	// a relative work directory is below the agent installation
+	if workDir := path.Clean(m.Spec.Pool.WorkDir); path.IsAbs(workDir) && !strings.HasPrefix(workDir+"/", agentInstallPath+"/") {
+		paths["work"] = workDir
+		names = append(names, "work")
+	}
+
+	var volumes []corev1.Volume
+	var mounts []corev1.VolumeMount
+	for _, name := range names {
+		volumes = append(volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: paths[name]})
+	}
+	return volumes, mounts, []corev1.EnvVar{{Name: "HOME", Value: agentHomePath}}
+}
+
+// automountTokenForAgent only mounts a service account token in hardened
+// pods when the agents deploy to the cluster
+func automountTokenForAgent(m *azdevopsv1alpha1.Agent) *bool {
+	if m.Spec.SecurityProfile == "" || m.Spec.SecurityProfile == azdevopsv1alpha1.SecurityProfilePrivilegedDind {
+		return nil
+	}
+	automount := m.Spec.RBAC != nil
+	return &automount
+}
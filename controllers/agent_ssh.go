@@ -0,0 +1,203 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+const (
+	// defaultSSHPath is the .ssh directory of the root user of the agent image
+	defaultSSHPath = "/root/.ssh"
+	// sshKeysPath, sshKnownHostsPath and sshHomePath are where the init
+	// container mounts the Secret, the ConfigMap and the .ssh directory
+	sshKeysPath       = "/opt/azp-ssh/keys"
+	sshKnownHostsPath = "/opt/azp-ssh/known-hosts"
+	sshHomePath       = "/opt/azp-ssh/home"
+	// sshAgentSocket is the socket of the ssh-agent sidecar
+	sshAgentSocket = "/opt/azp-ssh/agent/agent.sock"
+)
+
+// installSSHScript installs known_hosts and config, and the private keys
+// unless they are loaded in the ssh-agent, with the permissions ssh requires
+const installSSHScript = `set -e
+chmod 700 ` + sshHomePath + `
+for file in ` + sshKeysPath + `/* ` + sshKnownHostsPath + `/*; do
+  [ -f "$file" ] || continue
+  name=${file##*/}
+  case "$name" in
+    known_hosts|config)
+      cp "$file" ` + sshHomePath + `/"$name"
+      chmod 644 ` + sshHomePath + `/"$name"
+      ;;
+    *)
+      if [ "$SSH_INSTALL_KEYS" = "true" ]; then
+        cp "$file" ` + sshHomePath + `/"$name"
+        chmod 600 ` + sshHomePath + `/"$name"
+      fi
+      ;;
+  esac
+done
+`
+
+// runSSHAgentScript starts ssh-agent and loads the private keys from the
+// Secret volume through stdin, so they are not copied to disk
+const runSSHAgentScript = `rm -f ` + sshAgentSocket + `
+ssh-agent -D -a ` + sshAgentSocket + ` &
+pid=$!
+while [ ! -S ` + sshAgentSocket + ` ]; do sleep 1; done
+for key in ` + sshKeysPath + `/*; do
+  case "${key##*/}" in known_hosts|config) continue ;; esac
+  SSH_AUTH_SOCK=` + sshAgentSocket + ` ssh-add - < "$key"
+done
+wait $pid
+`
+
+// checkSSH verifies the SSH Secret and known hosts ConfigMap exist, the
+// pods can not start without them
+func (r *AgentReconciler) checkSSH(ctx context.Context, m *azdevopsv1alpha1.Agent) (metav1.Condition, error) {
+	s := m.Spec.SSH
+	err := r.Get(ctx, types.NamespacedName{Name: s.SecretName, Namespace: m.Namespace}, &corev1.Secret{})
+	if err != nil && errors.IsNotFound(err) {
+		return metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionSSHKeysResolved,
+			Status:  metav1.ConditionFalse,
+			Reason:  "SecretNotFound",
+			Message: fmt.Sprintf("Secret %s not found", s.SecretName),
+		}, nil
+	} else if err != nil {
+		return metav1.Condition{}, err
+	}
+
+	if s.KnownHostsConfigMapName != "" {
+		// the ConfigMaps are not cached, only the referenced one is read
+		err := r.uncachedReader().Get(ctx, types.NamespacedName{Name: s.KnownHostsConfigMapName, Namespace: m.Namespace}, &corev1.ConfigMap{})
+		if err != nil && errors.IsNotFound(err) {
+			return metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionSSHKeysResolved,
+				Status:  metav1.ConditionFalse,
+				Reason:  "ConfigMapNotFound",
+				Message: fmt.Sprintf("ConfigMap %s not found", s.KnownHostsConfigMapName),
+			}, nil
+		} else if err != nil {
+			return metav1.Condition{}, err
+		}
+	}
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionSSHKeysResolved,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Resolved",
+		Message: fmt.Sprintf("SSH keys are read from Secret %s", s.SecretName),
+	}, nil
+}
+
+// sshForAgent returns the init container installing the .ssh directory,
+// the ssh-agent sidecar, the volumes, the mount of the .ssh directory and
+// the SSH_AUTH_SOCK of the sidecar
+func sshForAgent(m *azdevopsv1alpha1.Agent, securityContext *corev1.SecurityContext) ([]corev1.Container, []corev1.Container, []corev1.Volume, []corev1.VolumeMount, []corev1.EnvVar) {
+	s := m.Spec.SSH
+	if s == nil {
+		return nil, nil, nil, nil, nil
+	}
+
+	keysMode := int32(0400)
+	volumes := []corev1.Volume{
+		{
+			Name: "ssh-keys",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: s.SecretName, DefaultMode: &keysMode},
+			},
+		},
+		{
+			Name:         "ssh",
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		},
+	}
+	keysMount := corev1.VolumeMount{Name: "ssh-keys", MountPath: sshKeysPath, ReadOnly: true}
+	initMounts := []corev1.VolumeMount{keysMount, {Name: "ssh", MountPath: sshHomePath}}
+	if s.KnownHostsConfigMapName != "" {
+		volumes = append(volumes, corev1.Volume{
+			Name: "ssh-known-hosts",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: s.KnownHostsConfigMapName},
+					Items:                []corev1.KeyToPath{{Key: "known_hosts", Path: "known_hosts"}},
+				},
+			},
+		})
+		initMounts = append(initMounts, corev1.VolumeMount{Name: "ssh-known-hosts", MountPath: sshKnownHostsPath, ReadOnly: true})
+	}
+
+	installKeys := "true"
+	if s.Agent != nil {
+		installKeys = "false"
+	}
+	// the agent image has a shell, the files get the user of the agent
+	initContainers := []corev1.Container{{
+		Name:            "ssh-setup",
+		Image:           m.Spec.Image,
+		Command:         []string{"/bin/sh", "-c", installSSHScript},
+		SecurityContext: securityContext,
+		VolumeMounts:    initMounts,
+		Env:             []corev1.EnvVar{{Name: "SSH_INSTALL_KEYS", Value: installKeys}},
+	}}
+
+	sshPath := s.Path
+	if sshPath == "" {
+		sshPath = defaultSSHPath
+	}
+	mounts := []corev1.VolumeMount{{Name: "ssh", MountPath: sshPath}}
+	if s.Agent == nil {
+		return initContainers, nil, volumes, mounts, nil
+	}
+
+	volumes = append(volumes, corev1.Volume{
+		Name:         "ssh-agent",
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+	})
+	socketMount := corev1.VolumeMount{Name: "ssh-agent", MountPath: "/opt/azp-ssh/agent"}
+	image := s.Agent.Image
+	if image == "" {
+		image = m.Spec.Image
+	}
+	sidecar := corev1.Container{
+		Name:            "ssh-agent",
+		Image:           image,
+		Command:         []string{"/bin/sh", "-c", runSSHAgentScript},
+		SecurityContext: securityContext,
+		VolumeMounts:    []corev1.VolumeMount{keysMount, socketMount},
+		// keep the keys loaded while the agent finishes its job
+		Lifecycle: &corev1.Lifecycle{
+			PreStop: &corev1.Handler{
+				Exec: &corev1.ExecAction{
+					Command: []string{"/bin/sh", "-c", waitForJobScript},
+				},
+			},
+		},
+	}
+	mounts = append(mounts, socketMount)
+	env := []corev1.EnvVar{{Name: "SSH_AUTH_SOCK", Value: sshAgentSocket}}
+	return initContainers, []corev1.Container{sidecar}, volumes, mounts, env
+}
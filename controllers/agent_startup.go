@@ -0,0 +1,159 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+const (
+	// startupScriptsVolumeName is the name of the startup scripts volume
+	startupScriptsVolumeName = "startup-scripts"
+	// startupScriptsMountPath is the directory the startup scripts are mounted in
+	startupScriptsMountPath = "/opt/azp-startup"
+	// startupScriptFailed starts the termination message of a failed script
+	startupScriptFailed = "startup script "
+)
+
+// defaultAgentEntrypoint starts the agent in the working directory of the
+// agent image
+var defaultAgentEntrypoint = []string{"./start.sh"}
+
+// runStartupScripts runs the mounted scripts in order and then executes the
+// entrypoint passed as arguments. A failing script is written to the
+// termination message of the container.
+const runStartupScripts = `for script in ` + startupScriptsMountPath + `/*; do
+  [ -f "$script" ] || continue
+  echo "running ` + startupScriptFailed + `${script##*/}"
+  "$script"
+  rc=$?
+  if [ $rc -ne 0 ]; then
+    echo "` + startupScriptFailed + `${script##*/} failed with exit code $rc" | tee /dev/termination-log >&2
+    exit $rc
+  fi
+done
+exec "$@"
+`
+
+// startupScriptsForAgent returns the volume and mount of the startup
+// scripts, and the command and arguments running them before the agent
+func startupScriptsForAgent(m *azdevopsv1alpha1.Agent) ([]corev1.Volume, []corev1.VolumeMount, []string, []string) {
+	s := m.Spec.StartupScripts
+	if s == nil {
+		return nil, nil, nil, nil
+	}
+
+	mode := int32(0755)
+	source := &corev1.ConfigMapVolumeSource{
+		LocalObjectReference: corev1.LocalObjectReference{Name: s.ConfigMapName},
+		DefaultMode:          &mode,
+	}
+	// the scripts run in the order of their file names
+	for i, key := range s.Keys {
+		source.Items = append(source.Items, corev1.KeyToPath{Key: key, Path: fmt.Sprintf("%03d-%s", i, key)})
+	}
+	volumes := []corev1.Volume{{
+		Name:         startupScriptsVolumeName,
+		VolumeSource: corev1.VolumeSource{ConfigMap: source},
+	}}
+	mounts := []corev1.VolumeMount{{
+		Name:      startupScriptsVolumeName,
+		MountPath: startupScriptsMountPath,
+		ReadOnly:  true,
+	}}
+
+	entrypoint := s.Entrypoint
+	if len(entrypoint) == 0 {
+		entrypoint = defaultAgentEntrypoint
+	}
+	command := []string{"/bin/sh", "-c", runStartupScripts, startupScriptsVolumeName}
+	return volumes, mounts, command, entrypoint
+}
+
+// checkStartupScripts verifies the scripts exist in the ConfigMap and
+// reports the scripts that failed in the agent pods
+func (r *AgentReconciler) checkStartupScripts(ctx context.Context, m *azdevopsv1alpha1.Agent, pods []corev1.Pod) (metav1.Condition, error) {
+	s := m.Spec.StartupScripts
+	cm := corev1.ConfigMap{}
+	// the ConfigMaps are not cached, only the referenced one is read
+	err := r.uncachedReader().Get(ctx, types.NamespacedName{Name: s.ConfigMapName, Namespace: m.Namespace}, &cm)
+	if err != nil && errors.IsNotFound(err) {
+		return metav1.Condition{
+			Type:    azdevopsv1alpha1.ConditionStartupScriptsSucceeded,
+			Status:  metav1.ConditionFalse,
+			Reason:  "ConfigMapNotFound",
+			Message: fmt.Sprintf("ConfigMap %s not found", s.ConfigMapName),
+		}, nil
+	} else if err != nil {
+		return metav1.Condition{}, err
+	}
+	for _, key := range s.Keys {
+		if _, ok := cm.Data[key]; !ok {
+			return metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionStartupScriptsSucceeded,
+				Status:  metav1.ConditionFalse,
+				Reason:  "ScriptNotFound",
+				Message: fmt.Sprintf("ConfigMap %s has no script %s", s.ConfigMapName, key),
+			}, nil
+		}
+	}
+
+	for _, pod := range pods {
+		if message, failed := startupScriptFailure(pod); failed {
+			return metav1.Condition{
+				Type:    azdevopsv1alpha1.ConditionStartupScriptsSucceeded,
+				Status:  metav1.ConditionFalse,
+				Reason:  "ScriptFailed",
+				Message: fmt.Sprintf("%s in pod %s", message, pod.Name),
+			}, nil
+		}
+	}
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionStartupScriptsSucceeded,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Succeeded",
+		Message: fmt.Sprintf("no startup script of ConfigMap %s failed", s.ConfigMapName),
+	}, nil
+}
+
+// startupScriptFailure returns the termination message of an agent
+// container that stopped because a startup script failed, the previous
+// termination counts while the container waits to be restarted
+func startupScriptFailure(pod corev1.Pod) (string, bool) {
+	for _, status := range pod.Status.ContainerStatuses {
+		terminated := status.State.Terminated
+		if terminated == nil && status.State.Waiting != nil {
+			terminated = status.LastTerminationState.Terminated
+		}
+		if terminated == nil || terminated.ExitCode == 0 {
+			continue
+		}
+		if message := strings.TrimSpace(terminated.Message); strings.HasPrefix(message, startupScriptFailed) {
+			return message, true
+		}
+	}
+	return "", false
+}
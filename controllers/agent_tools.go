@@ -0,0 +1,177 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+)
+
+const (
+	// toolsVolumeName is the name of the volume the tools are copied to
+	toolsVolumeName = "tools"
+	// toolsMountPath is the directory the tools volume is mounted in
+	toolsMountPath = "/opt/azp-tools"
+	// toolsSetsDir is the directory on the cache volume holding the copied
+	// tools of every combination of tools
+	toolsSetsDir = "toolsets"
+)
+
+// copyToolScript copies TOOL_PATH into the bin directory of the tools volume
+// once, a marker file skips the copy when the tools are kept on the cache
+// volume. cp -f replaces a binary another pod is running.
+const copyToolScript = `set -e
+marker="` + toolsMountPath + `/.copied-$TOOL_NAME"
+[ -e "$marker" ] && exit 0
+mkdir -p ` + toolsMountPath + `/bin
+if [ -d "$TOOL_PATH" ]; then
+  cp -Rf "$TOOL_PATH"/. ` + toolsMountPath + `/bin/
+else
+  cp -f "$TOOL_PATH" ` + toolsMountPath + `/bin/
+fi
+touch "$marker"
+`
+
+// prependToolsPathScript puts the tools in front of the PATH of the image and
+// executes the command passed as arguments
+const prependToolsPathScript = `export PATH="` + toolsMountPath + `/bin:$PATH"
+exec "$@"
+`
+
+// toolsForAgent returns the init containers copying the tools, the tools
+// volume and its mount. With caches the tools
+// are copied once per combination of tools to the cache volume, so pods
+// started later skip the copy.
+func toolsForAgent(m *azdevopsv1alpha1.Agent, securityContext *corev1.SecurityContext) ([]corev1.Container, []corev1.Volume, []corev1.VolumeMount) {
+	if len(m.Spec.Tools) == 0 {
+		return nil, nil, nil
+	}
+
+	var volumes []corev1.Volume
+	mount := corev1.VolumeMount{Name: toolsVolumeName, MountPath: toolsMountPath}
+	if cacheVolumes, _, _ := cachesForAgent(m); len(cacheVolumes) > 0 {
+		mount.Name = cacheVolumeName
+		mount.SubPath = path.Join(toolsSetsDir, toolSetHash(m.Spec.Tools))
+	} else {
+		volumes = append(volumes, corev1.Volume{
+			Name:         toolsVolumeName,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+	}
+
+	var initContainers []corev1.Container
+	for _, tool := range m.Spec.Tools {
+		initContainers = append(initContainers, corev1.Container{
+			Name:            "tool-" + tool.Name,
+			Image:           tool.Image,
+			Command:         []string{"/bin/sh", "-c", copyToolScript},
+			SecurityContext: securityContext,
+			VolumeMounts:    []corev1.VolumeMount{mount},
+			Env: []corev1.EnvVar{
+				{Name: "TOOL_NAME", Value: tool.Name},
+				{Name: "TOOL_PATH", Value: tool.Path},
+			},
+		})
+	}
+
+	// the agent only runs the tools
+	agentMount := mount
+	agentMount.ReadOnly = true
+	return initContainers, volumes, []corev1.VolumeMount{agentMount}
+}
+
+// checkTools reports the tool init containers that failed to copy their
+// tool in the agent pods
+func checkTools(m *azdevopsv1alpha1.Agent, pods []corev1.Pod) metav1.Condition {
+	for _, pod := range pods {
+		if container, message, failed := toolFailure(pod); failed {
+			return metav1.Condition{
+				Type:   azdevopsv1alpha1.ConditionToolsInstalled,
+				Status: metav1.ConditionFalse,
+				Reason: "CopyFailed",
+				Message: fmt.Sprintf("init container %s failed in pod %s: %s, the tool image needs /bin/sh and cp",
+					container, pod.Name, message),
+			}
+		}
+	}
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionToolsInstalled,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Installed",
+		Message: fmt.Sprintf("no tool init container failed in the pods of %s", m.Name),
+	}
+}
+
+// toolFailure returns the name and error of a tool init container that
+// exited with an error or could not be started, the previous termination
+// counts while the container waits to be restarted
+func toolFailure(pod corev1.Pod) (string, string, bool) {
+	for _, status := range pod.Status.InitContainerStatuses {
+		if !strings.HasPrefix(status.Name, "tool-") {
+			continue
+		}
+		if waiting := status.State.Waiting; waiting != nil &&
+			(waiting.Reason == "CreateContainerError" || waiting.Reason == "RunContainerError") {
+			return status.Name, strings.TrimSpace(waiting.Reason + " " + waiting.Message), true
+		}
+		terminated := status.State.Terminated
+		if terminated == nil && status.State.Waiting != nil {
+			terminated = status.LastTerminationState.Terminated
+		}
+		if terminated == nil || terminated.ExitCode == 0 {
+			continue
+		}
+		message := fmt.Sprintf("exit code %d", terminated.ExitCode)
+		if terminated.Reason != "" {
+			message = terminated.Reason + " with " + message
+		}
+		return status.Name, message, true
+	}
+	return "", "", false
+}
+
+// toolsCommand wraps the command and arguments of the agent so it starts
+// with the tools in front of the PATH of the image, without a command the
+// entrypoint of the agent image is started
+func toolsCommand(m *azdevopsv1alpha1.Agent, command, args []string) ([]string, []string) {
+	if len(m.Spec.Tools) == 0 {
+		return command, args
+	}
+	entrypoint := append(append([]string{}, command...), args...)
+	if len(entrypoint) == 0 {
+		entrypoint = defaultAgentEntrypoint
+	}
+	return []string{"/bin/sh", "-c", prependToolsPathScript, toolsVolumeName}, entrypoint
+}
+
+// toolSetHash identifies a combination of tools, changing an image or path
+// copies the tools to a new directory
+func toolSetHash(tools []azdevopsv1alpha1.Tool) string {
+	h := sha256.New()
+	for _, tool := range tools {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\n", tool.Name, tool.Image, tool.Path)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
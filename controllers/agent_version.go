@@ -0,0 +1,159 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/azdevops-agent-operator/pkg/azdevops"
+)
+
+// defaultAgentPlatform is the platform of the agent packages installed in
+// the agent image
+const defaultAgentPlatform = "linux-x64"
+
+// reconcileAgentVersion resolves the agent version policy to a published
+// agent package and records it in the status. The operator does not change
+// pools it does not own, a pool without AgentPool that still updates its
+// agents is reported in the condition.
+func (r *AgentReconciler) reconcileAgentVersion(ctx context.Context, m *azdevopsv1alpha1.Agent) (metav1.Condition, error) {
+	logger := log.FromContext(ctx)
+	policy, version, platform := agentVersionPolicy(m)
+
+	ado := azdevops.NewClient(m.Spec.Pool.URL, m.Spec.Pool.Token)
+	packages, err := ado.ListAgentPackages(ctx, platform)
+	if err != nil {
+		return metav1.Condition{}, err
+	}
+	current := ""
+	if m.Status.AgentVersion != nil {
+		current = m.Status.AgentVersion.Version
+	}
+	pkg, err := selectAgentPackage(policy, version, current, packages)
+	if err != nil {
+		return metav1.Condition{}, err
+	}
+
+	selected := &azdevopsv1alpha1.AgentVersionStatus{Version: pkg.Version.String(), DownloadURL: pkg.DownloadURL}
+	if m.Status.AgentVersion == nil || *m.Status.AgentVersion != *selected {
+		logger.Info("Selected agent version", "Agent.Namespace", m.Namespace, "Agent.Name", m.Name, "Version", selected.Version, "Previous", current)
+		m.Status.AgentVersion = selected
+		if err = r.updateStatus(ctx, m); err != nil {
+			return metav1.Condition{}, err
+		}
+	}
+
+	// the autoUpdate of the pool of an AgentPool is set in the AgentPool
+	if m.Spec.Pool.AgentPoolRef == nil {
+		pool, err := ado.GetPoolByName(ctx, m.Spec.Pool.PoolName)
+		if err != nil {
+			return metav1.Condition{}, err
+		}
+		if pool.AutoUpdate == nil || *pool.AutoUpdate {
+			logger.Info("Pool in Azure DevOps updates its agents", "Agent.Namespace", m.Namespace, "Agent.Name", m.Name, "Pool.Name", pool.Name)
+			return metav1.Condition{
+				Type:   azdevopsv1alpha1.ConditionAgentVersionResolved,
+				Status: metav1.ConditionFalse,
+				Reason: "PoolAutoUpdateEnabled",
+				Message: fmt.Sprintf("agent version %s selected by policy %s but pool %s updates its agents, disable autoUpdate of the pool in Azure DevOps or manage the pool with an AgentPool",
+					selected.Version, policy, pool.Name),
+			}, nil
+		}
+	}
+
+	return metav1.Condition{
+		Type:    azdevopsv1alpha1.ConditionAgentVersionResolved,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Resolved",
+		Message: fmt.Sprintf("agent version %s selected by policy %s", selected.Version, policy),
+	}, nil
+}
+
+// agentVersionPolicy returns the policy, version and platform of m with
+// the defaults applied
+func agentVersionPolicy(m *azdevopsv1alpha1.Agent) (azdevopsv1alpha1.AgentVersionPolicy, string, string) {
+	policy := m.Spec.AgentVersion.Policy
+	if policy == "" {
+		policy = azdevopsv1alpha1.AgentVersionTrackLatest
+	}
+	platform := m.Spec.AgentVersion.Platform
+	if platform == "" {
+		platform = defaultAgentPlatform
+	}
+	return policy, m.Spec.AgentVersion.Version, platform
+}
+
+// selectAgentPackage picks the package the policy selects from packages,
+// newest first. TrackMinor without version tracks the minor version of the
+// current version, or of the latest package when there is none.
+func selectAgentPackage(policy azdevopsv1alpha1.AgentVersionPolicy, version, current string, packages []azdevops.Package) (*azdevops.Package, error) {
+	if len(packages) == 0 {
+		return nil, fmt.Errorf("no agent packages published")
+	}
+
+	switch policy {
+	case azdevopsv1alpha1.AgentVersionPinned:
+		pinned, err := azdevops.ParsePackageVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		for i := range packages {
+			if packages[i].Version == pinned {
+				return &packages[i], nil
+			}
+		}
+		return nil, fmt.Errorf("agent version %s is not published", pinned)
+	case azdevopsv1alpha1.AgentVersionTrackMinor:
+		if version == "" {
+			version = current
+		}
+		if version == "" {
+			version = packages[0].Version.String()
+		}
+		minor, err := azdevops.ParsePackageVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		for i := range packages {
+			if packages[i].Version.Major == minor.Major && packages[i].Version.Minor == minor.Minor {
+				return &packages[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no agent version %d.%d.x is published", minor.Major, minor.Minor)
+	default:
+		return &packages[0], nil
+	}
+}
+
+// agentVersionEnv passes the selected agent package to the agent image and
+// disables the self-update of the agent
+func agentVersionEnv(m *azdevopsv1alpha1.Agent) []corev1.EnvVar {
+	if m.Spec.AgentVersion == nil || m.Status.AgentVersion == nil {
+		return nil
+	}
+	return []corev1.EnvVar{
+		{Name: "AZP_AGENT_VERSION", Value: m.Status.AgentVersion.Version},
+		{Name: "AZP_AGENT_PACKAGE_URL", Value: m.Status.AgentVersion.DownloadURL},
+		{Name: "AZP_AGENT_DISABLEUPDATE", Value: "true"},
+	}
+}
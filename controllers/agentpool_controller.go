@@ -0,0 +1,290 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/azdevops-agent-operator/pkg/azdevops"
+)
+
+// agentPoolFinalizer deletes the pool in Azure DevOps before the AgentPool
+// is deleted when the deletion policy is Delete
+const agentPoolFinalizer = "azdevops.gofound.nl/pool-finalizer"
+
+// AgentPoolReconciler reconciles a AgentPool object
+type AgentPoolReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=azdevops.gofound.nl,resources=agentpools,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=azdevops.gofound.nl,resources=agentpools/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=azdevops.gofound.nl,resources=agentpools/finalizers,verbs=update
+
+// Reconcile creates or updates the organization level pool in Azure DevOps,
+// makes it available in the declared projects and reports the pool id in
+// the AgentPool status.
+func (r *AgentPoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	ctx, span := startReconcileSpan(ctx, "AgentPool", req.Namespace, req.Name)
+	defer func() { endSpan(span, err) }()
+	logger := log.FromContext(ctx)
+
+	/////////////////////////////////////////////////////////////////////////
+	// Fetch AgentPool object if it exists
+	agentPool := azdevopsv1alpha1.AgentPool{}
+	err = r.Get(ctx, req.NamespacedName, &agentPool)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			logger.Info("AgentPool resource not found. Ignoring since object must be deleted")
+			return ctrl.Result{}, nil
+		}
+		logger.Error(err, "Failed to get AgentPool")
+		return ctrl.Result{}, err
+	}
+
+	ado := azdevops.NewClient(agentPool.Spec.URL, agentPool.Spec.Token)
+	poolName := poolNameForAgentPool(&agentPool)
+
+	/////////////////////////////////////////////////////////////////////////
+	// Delete the pool in Azure DevOps before the AgentPool is deleted
+	if !agentPool.DeletionTimestamp.IsZero() {
+		if controllerutil.ContainsFinalizer(&agentPool, agentPoolFinalizer) {
+			if agentPool.Spec.DeletionPolicy == azdevopsv1alpha1.DeletionPolicyDelete && agentPool.Status.PoolID != 0 {
+				if !agentPool.Status.Created {
+					// a pool the operator adopted belongs to someone else
+					logger.Info("Retaining pool in Azure DevOps the operator did not create", "Pool.Name", poolName, "Pool.ID", agentPool.Status.PoolID)
+				} else {
+					logger.Info("Deleting pool in Azure DevOps", "Pool.Name", poolName, "Pool.ID", agentPool.Status.PoolID)
+					if err = ado.DeletePool(ctx, agentPool.Status.PoolID); err != nil && !azdevops.IsNotFound(err) {
+						logger.Error(err, "Failed to delete pool in Azure DevOps", "Pool.Name", poolName)
+						return ctrl.Result{}, err
+					}
+				}
+			}
+			controllerutil.RemoveFinalizer(&agentPool, agentPoolFinalizer)
+			if err = r.Update(ctx, &agentPool); err != nil {
+				logger.Error(err, "Failed to remove finalizer", "AgentPool.Namespace", agentPool.Namespace, "AgentPool.Name", agentPool.Name)
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+	if !controllerutil.ContainsFinalizer(&agentPool, agentPoolFinalizer) {
+		controllerutil.AddFinalizer(&agentPool, agentPoolFinalizer)
+		if err = r.Update(ctx, &agentPool); err != nil {
+			logger.Error(err, "Failed to add finalizer", "AgentPool.Namespace", agentPool.Namespace, "AgentPool.Name", agentPool.Name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure the pool exists in Azure DevOps with the declared settings
+	pool, created, err := r.reconcilePool(ctx, ado, &agentPool)
+	if err != nil {
+		logger.Error(err, "Failed to reconcile pool in Azure DevOps", "Pool.Name", poolName)
+		return ctrl.Result{}, r.setNotReady(ctx, &agentPool, "PoolFailed", err)
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Ensure the pool has a queue in every declared project
+	queues := []azdevopsv1alpha1.ProjectQueueStatus{}
+	for _, project := range agentPool.Spec.Projects {
+		queue, err := r.reconcileQueue(ctx, ado, pool, project)
+		if err != nil {
+			logger.Error(err, "Failed to reconcile project queue in Azure DevOps", "Pool.Name", poolName, "Project", project.Name)
+			return ctrl.Result{}, r.setNotReady(ctx, &agentPool, "QueueFailed", err)
+		}
+		queues = append(queues, azdevopsv1alpha1.ProjectQueueStatus{Project: project.Name, QueueID: queue.ID})
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Remove the queues of projects that are no longer declared
+	if err = r.pruneQueues(ctx, ado, &agentPool, queues); err != nil {
+		logger.Error(err, "Failed to remove project queue in Azure DevOps", "Pool.Name", poolName)
+		return ctrl.Result{}, r.setNotReady(ctx, &agentPool, "QueueFailed", err)
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Update AgentPool status with the pool and queue ids
+	status := agentPool.Status.DeepCopy()
+	status.PoolID = pool.ID
+	status.Created = created
+	status.Queues = queues
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               azdevopsv1alpha1.ConditionPoolReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Provisioned",
+		Message:            fmt.Sprintf("pool %s is available in %d projects", pool.Name, len(queues)),
+		ObservedGeneration: agentPool.Generation,
+	})
+	if !reflect.DeepEqual(status, &agentPool.Status) {
+		agentPool.Status = *status
+		if err = r.Status().Update(ctx, &agentPool); err != nil {
+			logger.Error(err, "Failed to update AgentPool status")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Requeue to correct changes made in the Azure DevOps portal
+	return ctrl.Result{RequeueAfter: 10 * time.Minute}, nil
+}
+
+// reconcilePool creates the pool or updates its settings. The pool is found
+// by the id in the status, so a changed pool name renames the pool instead
+// of creating a new one. It returns whether the operator created the pool,
+// a pool found by name already existed and is adopted.
+func (r *AgentPoolReconciler) reconcilePool(ctx context.Context, ado *azdevops.Client, m *azdevopsv1alpha1.AgentPool) (*azdevops.Pool, bool, error) {
+	logger := log.FromContext(ctx)
+	desired := &azdevops.Pool{
+		Name:          poolNameForAgentPool(m),
+		AutoProvision: m.Spec.AutoProvision,
+		AutoUpdate:    m.Spec.AutoUpdate,
+	}
+
+	var pool *azdevops.Pool
+	var err error
+	created := false
+	if m.Status.PoolID != 0 {
+		pool, err = ado.GetPool(ctx, m.Status.PoolID)
+		if err != nil && !azdevops.IsNotFound(err) {
+			return nil, false, err
+		}
+		// a pool deleted in the portal is looked up by name or recreated
+		created = pool != nil && m.Status.Created
+	}
+	if pool == nil {
+		pool, err = ado.GetPoolByName(ctx, desired.Name)
+		if err != nil && azdevops.IsNotFound(err) {
+			logger.Info("Creating a new pool in Azure DevOps", "Pool.Name", desired.Name)
+			pool, err = ado.CreatePool(ctx, desired)
+			return pool, err == nil, err
+		} else if err != nil {
+			return nil, false, err
+		}
+		logger.Info("Adopting existing pool in Azure DevOps", "Pool.Name", pool.Name, "Pool.ID", pool.ID)
+	}
+
+	if pool.Name != desired.Name || boolChanged(desired.AutoProvision, pool.AutoProvision) || boolChanged(desired.AutoUpdate, pool.AutoUpdate) {
+		logger.Info("Update existing pool in Azure DevOps", "Pool.Name", pool.Name, "Pool.ID", pool.ID, "NewName", desired.Name)
+		desired.ID = pool.ID
+		pool, err = ado.UpdatePool(ctx, desired)
+		return pool, created, err
+	}
+	return pool, created, nil
+}
+
+// reconcileQueue creates the queue of the pool in a project and sets its
+// pipeline permissions
+func (r *AgentPoolReconciler) reconcileQueue(ctx context.Context, ado *azdevops.Client, pool *azdevops.Pool, project azdevopsv1alpha1.ProjectQueue) (*azdevops.Queue, error) {
+	logger := log.FromContext(ctx)
+
+	queues, err := ado.ListQueues(ctx, project.Name, pool.ID)
+	if err != nil {
+		return nil, err
+	}
+	var queue *azdevops.Queue
+	if len(queues) > 0 {
+		queue = &queues[0]
+	} else {
+		logger.Info("Creating a new queue in Azure DevOps", "Pool.Name", pool.Name, "Project", project.Name)
+		queue, err = ado.CreateQueue(ctx, project.Name, &azdevops.Queue{
+			Name: pool.Name,
+			Pool: &azdevops.Pool{ID: pool.ID, Name: pool.Name},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = ado.AuthorizeQueue(ctx, project.Name, queue.ID, project.AuthorizeAllPipelines); err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+// pruneQueues removes the pool from the projects in the status that are
+// not part of the desired queues
+func (r *AgentPoolReconciler) pruneQueues(ctx context.Context, ado *azdevops.Client, m *azdevopsv1alpha1.AgentPool, queues []azdevopsv1alpha1.ProjectQueueStatus) error {
+	desired := map[string]bool{}
+	for _, queue := range queues {
+		desired[queue.Project] = true
+	}
+	for _, queue := range m.Status.Queues {
+		if desired[queue.Project] {
+			continue
+		}
+		log.FromContext(ctx).Info("Deleting queue in Azure DevOps", "Project", queue.Project, "Queue.ID", queue.QueueID)
+		if err := ado.DeleteQueue(ctx, queue.Project, queue.QueueID); err != nil && !azdevops.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// setNotReady records a failed reconciliation in the AgentPool status and
+// returns the original error so the request is retried
+func (r *AgentPoolReconciler) setNotReady(ctx context.Context, m *azdevopsv1alpha1.AgentPool, reason string, cause error) error {
+	meta.SetStatusCondition(&m.Status.Conditions, metav1.Condition{
+		Type:               azdevopsv1alpha1.ConditionPoolReady,
+		Status:             metav1.ConditionFalse,
+		Reason:             reason,
+		Message:            cause.Error(),
+		ObservedGeneration: m.Generation,
+	})
+	if err := r.Status().Update(ctx, m); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update AgentPool status")
+	}
+	return cause
+}
+
+// poolNameForAgentPool returns the name of the pool in Azure DevOps
+func poolNameForAgentPool(m *azdevopsv1alpha1.AgentPool) string {
+	if m.Spec.PoolName != "" {
+		return m.Spec.PoolName
+	}
+	return m.Name
+}
+
+// boolChanged returns true if a desired setting differs from the current
+// value, unset desired settings are left as they are
+func boolChanged(desired, current *bool) bool {
+	if desired == nil {
+		return false
+	}
+	return current == nil || *desired != *current
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *AgentPoolReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&azdevopsv1alpha1.AgentPool{}).
+		Complete(r)
+}
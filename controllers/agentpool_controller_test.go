@@ -0,0 +1,189 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/azdevops-agent-operator/pkg/azdevops"
+)
+
+var _ = Describe("AgentPool controller", func() {
+	var (
+		ctx       context.Context
+		namespace string
+		poolName  string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "agentpool-test-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		namespace = ns.Name
+		poolName = "pool-" + namespace
+	})
+
+	newAgentPool := func(name string, projects ...string) *azdevopsv1alpha1.AgentPool {
+		agentPool := &azdevopsv1alpha1.AgentPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec: azdevopsv1alpha1.AgentPoolSpec{
+				URL:      ado.URL,
+				Token:    testToken,
+				PoolName: poolName,
+			},
+		}
+		for _, project := range projects {
+			agentPool.Spec.Projects = append(agentPool.Spec.Projects, azdevopsv1alpha1.ProjectQueue{Name: project})
+		}
+		return agentPool
+	}
+
+	getAgentPool := func(name string) func() (*azdevopsv1alpha1.AgentPool, error) {
+		return func() (*azdevopsv1alpha1.AgentPool, error) {
+			agentPool := &azdevopsv1alpha1.AgentPool{}
+			err := k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, agentPool)
+			return agentPool, err
+		}
+	}
+
+	ready := func(name string) func() bool {
+		return func() bool {
+			agentPool, err := getAgentPool(name)()
+			return err == nil && meta.IsStatusConditionTrue(agentPool.Status.Conditions, azdevopsv1alpha1.ConditionPoolReady)
+		}
+	}
+
+	// updateAgentPool retries f on conflicts with the status updates of the controller
+	updateAgentPool := func(name string, f func(*azdevopsv1alpha1.AgentPool)) {
+		Eventually(func() error {
+			agentPool, err := getAgentPool(name)()
+			if err != nil {
+				return err
+			}
+			f(agentPool)
+			return k8sClient.Update(ctx, agentPool)
+		}, timeout, interval).Should(Succeed())
+	}
+
+	queueCount := func(project string) func() int {
+		return func() int {
+			return len(ado.projectQueues(project))
+		}
+	}
+
+	Context("when an AgentPool is created", func() {
+		It("creates the pool and its project queues", func() {
+			project := "project-" + namespace
+			Expect(k8sClient.Create(ctx, newAgentPool("create", project))).To(Succeed())
+
+			Eventually(ready("create"), timeout, interval).Should(BeTrue())
+			agentPool, err := getAgentPool("create")()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ado.poolsNamed(poolName)).To(HaveLen(1))
+			Expect(agentPool.Status.PoolID).To(Equal(ado.poolsNamed(poolName)[0].ID))
+			Expect(agentPool.Status.Queues).To(HaveLen(1))
+			Expect(ado.projectQueues(project)).To(HaveLen(1))
+		})
+	})
+
+	Context("when a project is removed", func() {
+		It("removes the queue of the pool from the project", func() {
+			kept, removed := "kept-"+namespace, "removed-"+namespace
+			Expect(k8sClient.Create(ctx, newAgentPool("prune", kept, removed))).To(Succeed())
+			Eventually(queueCount(removed), timeout, interval).Should(Equal(1))
+
+			updateAgentPool("prune", func(agentPool *azdevopsv1alpha1.AgentPool) {
+				agentPool.Spec.Projects = []azdevopsv1alpha1.ProjectQueue{{Name: kept}}
+			})
+			Eventually(queueCount(removed), timeout, interval).Should(Equal(0))
+			Expect(ado.projectQueues(kept)).To(HaveLen(1))
+			Eventually(func() ([]azdevopsv1alpha1.ProjectQueueStatus, error) {
+				agentPool, err := getAgentPool("prune")()
+				return agentPool.Status.Queues, err
+			}, timeout, interval).Should(HaveLen(1))
+		})
+	})
+
+	Context("when the pool name changes", func() {
+		It("renames the pool instead of creating a new one", func() {
+			Expect(k8sClient.Create(ctx, newAgentPool("rename"))).To(Succeed())
+			Eventually(ready("rename"), timeout, interval).Should(BeTrue())
+			agentPool, err := getAgentPool("rename")()
+			Expect(err).NotTo(HaveOccurred())
+			poolID := agentPool.Status.PoolID
+
+			renamed := "renamed-" + namespace
+			updateAgentPool("rename", func(agentPool *azdevopsv1alpha1.AgentPool) {
+				agentPool.Spec.PoolName = renamed
+			})
+			Eventually(func() string {
+				return ado.pool(poolID).Name
+			}, timeout, interval).Should(Equal(renamed))
+			Expect(ado.poolsNamed(poolName)).To(BeEmpty())
+			Consistently(func() []azdevops.Pool {
+				return ado.poolsNamed(renamed)
+			}, timeout/5, interval).Should(HaveLen(1))
+		})
+	})
+
+	Context("when an AgentPool with deletionPolicy Delete is deleted", func() {
+		deleted := func(name string) func() bool {
+			return func() bool {
+				_, err := getAgentPool(name)()
+				return apierrors.IsNotFound(err)
+			}
+		}
+
+		It("deletes the pool it created", func() {
+			agentPool := newAgentPool("delete-created")
+			agentPool.Spec.DeletionPolicy = azdevopsv1alpha1.DeletionPolicyDelete
+			Expect(k8sClient.Create(ctx, agentPool)).To(Succeed())
+			Eventually(ready("delete-created"), timeout, interval).Should(BeTrue())
+			created, err := getAgentPool("delete-created")()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(created.Status.Created).To(BeTrue())
+
+			Expect(k8sClient.Delete(ctx, agentPool)).To(Succeed())
+			Eventually(deleted("delete-created"), timeout, interval).Should(BeTrue())
+			Expect(ado.poolsNamed(poolName)).To(BeEmpty())
+		})
+
+		It("retains a pool that existed before", func() {
+			ado.addPool(poolName)
+			agentPool := newAgentPool("delete-adopted")
+			agentPool.Spec.DeletionPolicy = azdevopsv1alpha1.DeletionPolicyDelete
+			Expect(k8sClient.Create(ctx, agentPool)).To(Succeed())
+			Eventually(ready("delete-adopted"), timeout, interval).Should(BeTrue())
+			adopted, err := getAgentPool("delete-adopted")()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(adopted.Status.Created).To(BeFalse())
+
+			Expect(k8sClient.Delete(ctx, agentPool)).To(Succeed())
+			Eventually(deleted("delete-adopted"), timeout, interval).Should(BeTrue())
+			Expect(ado.poolsNamed(poolName)).To(HaveLen(1))
+		})
+	})
+})
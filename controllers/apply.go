@@ -0,0 +1,103 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// fieldManager is the field manager of the server-side applied resources,
+// fields set by other managers are left as they are
+const fieldManager = "azdevops-agent-operator"
+
+// legacyFieldManager is the field manager of the updates made by the
+// manager binary before the resources were applied
+const legacyFieldManager = "manager"
+
+// apply server-side applies the desired state of obj with the operator
+// field manager. Conflicting fields are taken over from other managers, obj
+// receives the object as stored by the API server. It returns create or
+// update when the object was created or changed, or an empty string.
+func (r *AgentReconciler) apply(ctx context.Context, obj client.Object) (string, error) {
+	// the apply patch is the serialized object, it needs the type
+	gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+	if err != nil {
+		return "", err
+	}
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	obj.SetManagedFields(nil)
+	obj.SetResourceVersion("")
+
+	found := obj.DeepCopyObject().(client.Object)
+	version := ""
+	if err := r.Get(ctx, client.ObjectKeyFromObject(obj), found); err == nil {
+		version = found.GetResourceVersion()
+	} else if client.IgnoreNotFound(err) != nil {
+		return "", err
+	}
+
+	if err := r.Patch(ctx, obj, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return "", err
+	}
+	kind := gvk.Kind
+	switch {
+	case version == "":
+		log.FromContext(ctx).Info("Created a new "+kind, kind+".Namespace", obj.GetNamespace(), kind+".Name", obj.GetName())
+		return "create", nil
+	case obj.GetResourceVersion() != version:
+		log.FromContext(ctx).Info("Updated existing "+kind, kind+".Namespace", obj.GetNamespace(), kind+".Name", obj.GetName())
+		return "update", nil
+	}
+	return "", nil
+}
+
+// ownsField returns true if the operator field manager applied the field at
+// path, like spec and replicas. Other managers, like a HorizontalPodAutoscaler,
+// take over the ownership when they change a field. Fields last updated by
+// the manager binary before it applied its resources count as owned.
+func ownsField(obj metav1.Object, path ...string) bool {
+	for _, entry := range obj.GetManagedFields() {
+		applied := entry.Manager == fieldManager && entry.Operation == metav1.ManagedFieldsOperationApply
+		legacy := entry.Manager == legacyFieldManager && entry.Operation == metav1.ManagedFieldsOperationUpdate
+		if (!applied && !legacy) || entry.FieldsV1 == nil {
+			continue
+		}
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		owned := true
+		for _, name := range path {
+			next, ok := fields["f:"+name].(map[string]interface{})
+			if !ok {
+				owned = false
+				break
+			}
+			fields = next
+		}
+		if owned {
+			return true
+		}
+	}
+	return false
+}
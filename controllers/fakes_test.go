@@ -0,0 +1,541 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/bartvanbenthem/azdevops-agent-operator/pkg/azdevops"
+)
+
+// testToken is the personal access token the fake Azure DevOps accepts
+const testToken = "test-token"
+
+var (
+	poolsPath        = regexp.MustCompile(`^/_apis/distributedtask/pools$`)
+	poolPath         = regexp.MustCompile(`^/_apis/distributedtask/pools/([0-9]+)$`)
+	packagesPath     = regexp.MustCompile(`^/_apis/distributedtask/packages/agent$`)
+	agentsPath       = regexp.MustCompile(`^/_apis/distributedtask/pools/([0-9]+)/agents$`)
+	agentPath        = regexp.MustCompile(`^/_apis/distributedtask/pools/([0-9]+)/agents/([0-9]+)$`)
+	jobRequestsPath  = regexp.MustCompile(`^/_apis/distributedtask/pools/([0-9]+)/jobrequests$`)
+	queuesPath       = regexp.MustCompile(`^/([^/_][^/]*)/_apis/distributedtask/queues$`)
+	queuePath        = regexp.MustCompile(`^/([^/_][^/]*)/_apis/distributedtask/queues/([0-9]+)$`)
+	permissionPath   = regexp.MustCompile(`^/([^/_][^/]*)/_apis/pipelines/pipelinepermissions/queue/([0-9]+)$`)
+	projectPath      = regexp.MustCompile(`^/_apis/projects/([^/]+)$`)
+	environmentsPath = regexp.MustCompile(`^/([^/_][^/]*)/_apis/distributedtask/environments$`)
+	resourcesPath    = regexp.MustCompile(`^/([^/_][^/]*)/_apis/distributedtask/environments/([0-9]+)/providers/kubernetes$`)
+	resourcePath     = regexp.MustCompile(`^/([^/_][^/]*)/_apis/distributedtask/environments/([0-9]+)/providers/kubernetes/([0-9]+)$`)
+	endpointsPath    = regexp.MustCompile(`^/_apis/serviceendpoint/endpoints$`)
+	endpointPath     = regexp.MustCompile(`^/_apis/serviceendpoint/endpoints/([^/]+)$`)
+)
+
+// fakeADO is an in-process Azure DevOps organization serving the pool and
+// agent calls the operator makes
+type fakeADO struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	token    string
+	nextID   int
+	pools    []azdevops.Pool
+	agents   map[int][]azdevops.Agent
+	packages []azdevops.Package
+	jobs     map[int][]azdevops.JobRequest
+	// queues and environments are the queues and environments per project
+	queues       map[string][]azdevops.Queue
+	environments map[string][]azdevops.Environment
+	// resources are the Kubernetes resources per environment id
+	resources map[int][]azdevops.KubernetesResource
+	endpoints map[string]azdevops.ServiceEndpoint
+	// failures is the number of next requests answered with failStatus
+	failures   int
+	failStatus int
+}
+
+func newFakeADO(token string) *fakeADO {
+	f := &fakeADO{
+		token:        token,
+		agents:       map[int][]azdevops.Agent{},
+		jobs:         map[int][]azdevops.JobRequest{},
+		queues:       map[string][]azdevops.Queue{},
+		environments: map[string][]azdevops.Environment{},
+		resources:    map[int][]azdevops.KubernetesResource{},
+		endpoints:    map[string]azdevops.ServiceEndpoint{},
+	}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+// addPool creates a pool and returns its id
+func (f *fakeADO) addPool(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	f.pools = append(f.pools, azdevops.Pool{ID: f.nextID, Name: name})
+	return f.nextID
+}
+
+// registerAgent registers an online agent in a pool, busy agents run a job
+func (f *fakeADO) registerAgent(poolID int, name string, busy bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	a := azdevops.Agent{ID: f.nextID, Name: name, Enabled: true, Status: "online"}
+	if busy {
+		a.AssignedRequest = &azdevops.JobRequest{RequestID: f.nextID}
+	}
+	f.agents[poolID] = append(f.agents[poolID], a)
+}
+
+// agent returns the registration of the agent with name
+func (f *fakeADO) agent(poolID int, name string) (azdevops.Agent, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, a := range f.agents[poolID] {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return azdevops.Agent{}, false
+}
+
+// publishAgent publishes a linux-x64 agent package with version
+func (f *fakeADO) publishAgent(version string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, _ := azdevops.ParsePackageVersion(version)
+	f.packages = append(f.packages, azdevops.Package{
+		Type:        "agent",
+		Platform:    "linux-x64",
+		Version:     v,
+		DownloadURL: "https://example.com/agent/" + version + "/vsts-agent-linux-x64-" + version + ".tar.gz",
+	})
+}
+
+// pool returns the pool with id
+func (f *fakeADO) pool(id int) azdevops.Pool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.pools {
+		if p.ID == id {
+			return p
+		}
+	}
+	return azdevops.Pool{}
+}
+
+// setAutoUpdate changes the autoUpdate setting of a pool
+func (f *fakeADO) setAutoUpdate(id int, autoUpdate bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.pools {
+		if f.pools[i].ID == id {
+			f.pools[i].AutoUpdate = &autoUpdate
+		}
+	}
+}
+
+// poolsNamed returns the pools with name
+func (f *fakeADO) poolsNamed(name string) []azdevops.Pool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pools := []azdevops.Pool{}
+	for _, p := range f.pools {
+		if p.Name == name {
+			pools = append(pools, p)
+		}
+	}
+	return pools
+}
+
+// projectQueues returns the queues in project
+func (f *fakeADO) projectQueues(project string) []azdevops.Queue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]azdevops.Queue{}, f.queues[project]...)
+}
+
+// environmentResources returns the Kubernetes resources registered in the
+// environment with name
+func (f *fakeADO) environmentResources(project, name string) []azdevops.KubernetesResource {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range f.environments[project] {
+		if e.Name == name {
+			return append([]azdevops.KubernetesResource{}, f.resources[e.ID]...)
+		}
+	}
+	return nil
+}
+
+// serviceEndpoints returns the number of service endpoints
+func (f *fakeADO) serviceEndpoints() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.endpoints)
+}
+
+// serviceEndpointToken returns the decoded token of the service endpoint
+// with name
+func (f *fakeADO) serviceEndpointToken(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range f.endpoints {
+		if e.Name == name {
+			token, _ := base64.StdEncoding.DecodeString(e.Authorization.Parameters["apiToken"])
+			return string(token)
+		}
+	}
+	return ""
+}
+
+// completeJob records a job that finished now on the agent with name
+func (f *fakeADO) completeJob(poolID int, name, result string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	now := time.Now()
+	f.jobs[poolID] = append(f.jobs[poolID], azdevops.JobRequest{
+		RequestID:     f.nextID,
+		QueueTime:     &now,
+		AssignTime:    &now,
+		ReceiveTime:   &now,
+		FinishTime:    &now,
+		Result:        result,
+		ReservedAgent: &azdevops.Agent{Name: name},
+	})
+}
+
+// failNext answers the next n requests with status
+func (f *fakeADO) failNext(n, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = n
+	f.failStatus = status
+}
+
+func (f *fakeADO) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(":"+f.token))
+	if req.Header.Get("Authorization") != auth {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		http.Error(w, "injected failure", f.failStatus)
+		return
+	}
+
+	path := req.URL.Path
+	switch {
+	case poolsPath.MatchString(path) && req.Method == http.MethodGet:
+		pools := []azdevops.Pool{}
+		for _, p := range f.pools {
+			if name := req.URL.Query().Get("poolName"); name == "" || name == p.Name {
+				pools = append(pools, p)
+			}
+		}
+		writeList(w, pools)
+	case poolsPath.MatchString(path) && req.Method == http.MethodPost:
+		pool := azdevops.Pool{}
+		if err := json.NewDecoder(req.Body).Decode(&pool); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		pool.ID = f.nextID
+		f.pools = append(f.pools, pool)
+		writeJSON(w, pool)
+	case poolPath.MatchString(path) && req.Method == http.MethodGet:
+		poolID := pathID(poolPath, path, 1)
+		for _, p := range f.pools {
+			if p.ID == poolID {
+				writeJSON(w, p)
+				return
+			}
+		}
+		http.NotFound(w, req)
+	case poolPath.MatchString(path) && req.Method == http.MethodPatch:
+		poolID := pathID(poolPath, path, 1)
+		body := struct {
+			Name          string `json:"name"`
+			AutoProvision *bool  `json:"autoProvision"`
+			AutoUpdate    *bool  `json:"autoUpdate"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i, p := range f.pools {
+			if p.ID == poolID {
+				if body.Name != "" {
+					f.pools[i].Name = body.Name
+				}
+				if body.AutoProvision != nil {
+					f.pools[i].AutoProvision = body.AutoProvision
+				}
+				if body.AutoUpdate != nil {
+					f.pools[i].AutoUpdate = body.AutoUpdate
+				}
+				writeJSON(w, f.pools[i])
+				return
+			}
+		}
+		http.NotFound(w, req)
+	case poolPath.MatchString(path) && req.Method == http.MethodDelete:
+		poolID := pathID(poolPath, path, 1)
+		for i, p := range f.pools {
+			if p.ID == poolID {
+				f.pools = append(f.pools[:i], f.pools[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.NotFound(w, req)
+	case queuesPath.MatchString(path) && req.Method == http.MethodGet:
+		project := queuesPath.FindStringSubmatch(path)[1]
+		poolID, _ := strconv.Atoi(req.URL.Query().Get("poolIds"))
+		queues := []azdevops.Queue{}
+		for _, q := range f.queues[project] {
+			if q.Pool != nil && q.Pool.ID == poolID {
+				queues = append(queues, q)
+			}
+		}
+		writeList(w, queues)
+	case queuesPath.MatchString(path) && req.Method == http.MethodPost:
+		project := queuesPath.FindStringSubmatch(path)[1]
+		queue := azdevops.Queue{}
+		if err := json.NewDecoder(req.Body).Decode(&queue); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		queue.ID = f.nextID
+		f.queues[project] = append(f.queues[project], queue)
+		writeJSON(w, queue)
+	case queuePath.MatchString(path) && req.Method == http.MethodDelete:
+		project, queueID := queuePath.FindStringSubmatch(path)[1], pathID(queuePath, path, 2)
+		for i, q := range f.queues[project] {
+			if q.ID == queueID {
+				f.queues[project] = append(f.queues[project][:i], f.queues[project][i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.NotFound(w, req)
+	case permissionPath.MatchString(path) && req.Method == http.MethodPatch:
+		writeJSON(w, map[string]interface{}{})
+	case projectPath.MatchString(path) && req.Method == http.MethodGet:
+		name := projectPath.FindStringSubmatch(path)[1]
+		writeJSON(w, azdevops.Project{ID: "id-" + name, Name: name})
+	case environmentsPath.MatchString(path) && req.Method == http.MethodGet:
+		project := environmentsPath.FindStringSubmatch(path)[1]
+		environments := []azdevops.Environment{}
+		for _, e := range f.environments[project] {
+			if e.Name == req.URL.Query().Get("name") {
+				environments = append(environments, e)
+			}
+		}
+		writeList(w, environments)
+	case environmentsPath.MatchString(path) && req.Method == http.MethodPost:
+		project := environmentsPath.FindStringSubmatch(path)[1]
+		environment := azdevops.Environment{}
+		if err := json.NewDecoder(req.Body).Decode(&environment); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		environment.ID = f.nextID
+		f.environments[project] = append(f.environments[project], environment)
+		writeJSON(w, environment)
+	case resourcesPath.MatchString(path) && req.Method == http.MethodPost:
+		environmentID := pathID(resourcesPath, path, 2)
+		resource := azdevops.KubernetesResource{}
+		if err := json.NewDecoder(req.Body).Decode(&resource); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		resource.ID = f.nextID
+		f.resources[environmentID] = append(f.resources[environmentID], resource)
+		writeJSON(w, resource)
+	case resourcePath.MatchString(path) && (req.Method == http.MethodGet || req.Method == http.MethodDelete):
+		environmentID, resourceID := pathID(resourcePath, path, 2), pathID(resourcePath, path, 3)
+		for i, r := range f.resources[environmentID] {
+			if r.ID == resourceID {
+				if req.Method == http.MethodDelete {
+					f.resources[environmentID] = append(f.resources[environmentID][:i], f.resources[environmentID][i+1:]...)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				writeJSON(w, r)
+				return
+			}
+		}
+		http.NotFound(w, req)
+	case endpointsPath.MatchString(path) && req.Method == http.MethodPost:
+		endpoint := azdevops.ServiceEndpoint{}
+		if err := json.NewDecoder(req.Body).Decode(&endpoint); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		endpoint.ID = strconv.Itoa(f.nextID)
+		f.endpoints[endpoint.ID] = endpoint
+		writeJSON(w, endpoint)
+	case endpointPath.MatchString(path) && req.Method == http.MethodPut:
+		id := endpointPath.FindStringSubmatch(path)[1]
+		if _, ok := f.endpoints[id]; !ok {
+			http.NotFound(w, req)
+			return
+		}
+		endpoint := azdevops.ServiceEndpoint{}
+		if err := json.NewDecoder(req.Body).Decode(&endpoint); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		endpoint.ID = id
+		f.endpoints[id] = endpoint
+		writeJSON(w, endpoint)
+	case endpointPath.MatchString(path) && req.Method == http.MethodDelete:
+		id := endpointPath.FindStringSubmatch(path)[1]
+		if _, ok := f.endpoints[id]; !ok {
+			http.NotFound(w, req)
+			return
+		}
+		delete(f.endpoints, id)
+		w.WriteHeader(http.StatusNoContent)
+	case packagesPath.MatchString(path) && req.Method == http.MethodGet:
+		packages := []azdevops.Package{}
+		for _, p := range f.packages {
+			if p.Platform == req.URL.Query().Get("platform") {
+				packages = append(packages, p)
+			}
+		}
+		writeList(w, packages)
+	case agentsPath.MatchString(path) && req.Method == http.MethodGet:
+		poolID := pathID(agentsPath, path, 1)
+		writeList(w, f.agents[poolID])
+	case agentPath.MatchString(path) && req.Method == http.MethodPatch:
+		poolID, agentID := pathID(agentPath, path, 1), pathID(agentPath, path, 2)
+		body := struct {
+			Enabled bool `json:"enabled"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i, a := range f.agents[poolID] {
+			if a.ID == agentID {
+				f.agents[poolID][i].Enabled = body.Enabled
+				writeJSON(w, f.agents[poolID][i])
+				return
+			}
+		}
+		http.NotFound(w, req)
+	case jobRequestsPath.MatchString(path) && req.Method == http.MethodGet:
+		poolID := pathID(jobRequestsPath, path, 1)
+		writeList(w, append([]azdevops.JobRequest{}, f.jobs[poolID]...))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func pathID(re *regexp.Regexp, path string, group int) int {
+	id, _ := strconv.Atoi(re.FindStringSubmatch(path)[group])
+	return id
+}
+
+func writeList(w http.ResponseWriter, values interface{}) {
+	writeJSON(w, map[string]interface{}{
+		"count": reflect.ValueOf(values).Len(),
+		"value": values,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// faultyClient answers updates and patches of a kind with a conflict while
+// conflicts are armed, like a write racing with another writer would
+type faultyClient struct {
+	client.Client
+
+	mu        sync.Mutex
+	kind      string
+	conflicts int
+}
+
+// conflictNext answers the next n updates or patches of kind with a conflict
+func (c *faultyClient) conflictNext(kind string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kind = kind
+	c.conflicts = n
+}
+
+// remainingConflicts returns the number of conflicts not yet returned
+func (c *faultyClient) remainingConflicts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conflicts
+}
+
+// conflict returns an injected conflict for obj while conflicts are armed
+func (c *faultyClient) conflict(obj client.Object) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kind := reflect.TypeOf(obj).Elem().Name()
+	if c.conflicts > 0 && kind == c.kind {
+		c.conflicts--
+		return apierrors.NewConflict(schema.GroupResource{Resource: kind}, obj.GetName(), errors.New("injected conflict"))
+	}
+	return nil
+}
+
+func (c *faultyClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if err := c.conflict(obj); err != nil {
+		return err
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *faultyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := c.conflict(obj); err != nil {
+		return err
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
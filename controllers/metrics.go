@@ -0,0 +1,372 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
+	"github.com/bartvanbenthem/azdevops-agent-operator/pkg/azdevops"
+)
+
+const (
+	metricsNamespace = "azdevops"
+	// metricsInterval is how often an Agent is reconciled to refresh the
+	// registered and busy agents and export the completed jobs
+	metricsInterval = time.Minute
+	// completedJobRequests is the number of completed jobs fetched per pool,
+	// it must cover the jobs completing within the metrics interval
+	completedJobRequests = 250
+	// poolSnapshotAge is how long the agents and jobs of a pool fetched for
+	// the metrics of one Agent are reused for the other Agents of the pool
+	poolSnapshotAge = metricsInterval / 2
+)
+
+var (
+	desiredAgents = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_desired_agents",
+		Help:      "Number of agents the Agent should run, including the active schedule",
+	}, []string{"namespace", "agent"})
+	readyAgents = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_ready_agents",
+		Help:      "Number of ready agent pods of the Agent",
+	}, []string{"namespace", "agent"})
+	registeredAgentsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_registered_agents",
+		Help:      "Number of agent pods of the Agent that are online in the Azure DevOps pool",
+	}, []string{"namespace", "agent"})
+	busyAgents = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_busy_agents",
+		Help:      "Number of agent pods of the Agent that are running a job",
+	}, []string{"namespace", "agent"})
+	reconcileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_reconcile_errors_total",
+		Help:      "Number of failed Agent reconciliations by the phase that failed",
+	}, []string{"namespace", "agent", "phase"})
+	resourceWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_resource_writes_total",
+		Help:      "Number of creates and updates of the resources owned by an Agent",
+	}, []string{"namespace", "agent", "kind", "operation"})
+	jobQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_queue_wait_seconds",
+		Help:      "Time completed jobs waited in the Azure DevOps queue for an agent of the Agent",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"namespace", "agent", "pool"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_duration_seconds",
+		Help:      "Time completed jobs ran on an agent of the Agent",
+		Buckets:   []float64{30, 60, 120, 300, 600, 1200, 1800, 3600, 7200, 14400},
+	}, []string{"namespace", "agent", "pool"})
+	jobResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_results_total",
+		Help:      "Number of completed jobs on the agents of the Agent by result",
+	}, []string{"namespace", "agent", "pool", "result"})
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of the requests to the Azure DevOps REST API",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"method", "operation", "code"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		desiredAgents,
+		readyAgents,
+		registeredAgentsGauge,
+		busyAgents,
+		reconcileErrors,
+		resourceWrites,
+		jobQueueWait,
+		jobDuration,
+		jobResults,
+		apiRequestDuration,
+	)
+}
+
+// seriesDeleter is a metric vector that removes a series by its label values
+type seriesDeleter interface {
+	DeleteLabelValues(lvs ...string) bool
+}
+
+// seriesKey identifies a series of a metric vector
+type seriesKey struct {
+	vec    seriesDeleter
+	labels string
+}
+
+// agentSeries keeps the label values of the counters and histograms exported
+// per Agent. These have labels next to the namespace and agent, and a series
+// can only be removed with all its label values.
+var agentSeries = struct {
+	sync.Mutex
+	series map[string]map[seriesKey][]string
+}{series: map[string]map[seriesKey][]string{}}
+
+// trackSeries records the series with labels so it is removed together with
+// the Agent, the first two labels are the namespace and agent
+func trackSeries(vec seriesDeleter, labels ...string) {
+	agent := labels[0] + "/" + labels[1]
+	agentSeries.Lock()
+	defer agentSeries.Unlock()
+	if agentSeries.series[agent] == nil {
+		agentSeries.series[agent] = map[seriesKey][]string{}
+	}
+	agentSeries.series[agent][seriesKey{vec: vec, labels: strings.Join(labels, "\xff")}] = labels
+}
+
+// recordError counts a failed reconciliation of an Agent in phase
+func recordError(namespace, agent, phase string) {
+	trackSeries(reconcileErrors, namespace, agent, phase)
+	reconcileErrors.WithLabelValues(namespace, agent, phase).Inc()
+}
+
+// recordWrite counts a create or update of a resource owned by an Agent
+func recordWrite(namespace, agent, kind, operation string) {
+	trackSeries(resourceWrites, namespace, agent, kind, operation)
+	resourceWrites.WithLabelValues(namespace, agent, kind, operation).Inc()
+}
+
+// poolSnapshot is the state of a pool read for the metrics
+type poolSnapshot struct {
+	fetched    time.Time
+	pool       *azdevops.Pool
+	registered map[string]azdevops.Agent
+	requests   []azdevops.JobRequest
+}
+
+// poolSnapshots shares the pool state between the Agents of a pool, so the
+// metrics of Agents sharing a pool do not repeat the same requests every
+// interval
+var poolSnapshots = struct {
+	sync.Mutex
+	snapshots map[string]*poolSnapshot
+}{snapshots: map[string]*poolSnapshot{}}
+
+// poolSnapshotFor returns a recent snapshot of a pool. Snapshots are keyed
+// by the organization, token and pool, so an Agent only reads a snapshot its
+// own token could have fetched.
+func poolSnapshotFor(ctx context.Context, ado *azdevops.Client, poolName string) (*poolSnapshot, error) {
+	sum := sha256.Sum256([]byte(ado.URL + "\n" + ado.Token + "\n" + poolName))
+	key := hex.EncodeToString(sum[:])
+
+	poolSnapshots.Lock()
+	snapshot, ok := poolSnapshots.snapshots[key]
+	poolSnapshots.Unlock()
+	if ok && time.Since(snapshot.fetched) < poolSnapshotAge {
+		return snapshot, nil
+	}
+
+	pool, err := ado.GetPoolByName(ctx, poolName)
+	if err != nil {
+		return nil, err
+	}
+	registered, err := registeredAgents(ctx, ado, pool.ID)
+	if err != nil {
+		return nil, err
+	}
+	requests, err := ado.ListJobRequests(ctx, pool.ID, completedJobRequests)
+	if err != nil {
+		return nil, err
+	}
+	snapshot = &poolSnapshot{fetched: time.Now(), pool: pool, registered: registered, requests: requests}
+
+	poolSnapshots.Lock()
+	defer poolSnapshots.Unlock()
+	// drop the snapshots of pools no Agent reads anymore
+	for k, s := range poolSnapshots.snapshots {
+		if time.Since(s.fetched) > 2*metricsInterval {
+			delete(poolSnapshots.snapshots, k)
+		}
+	}
+	poolSnapshots.snapshots[key] = snapshot
+	return snapshot, nil
+}
+
+// recordAgentMetrics exports the desired and ready agents of the Deployment
+// and the agents that are registered and busy in the Azure DevOps pool
+func (r *AgentReconciler) recordAgentMetrics(ctx context.Context, m *azdevopsv1alpha1.Agent, dep *appsv1.Deployment) error {
+	desiredAgents.WithLabelValues(m.Namespace, m.Name).Set(float64(m.Spec.Size))
+	readyAgents.WithLabelValues(m.Namespace, m.Name).Set(float64(dep.Status.ReadyReplicas))
+
+	ado := azdevops.NewClient(m.Spec.Pool.URL, m.Spec.Pool.Token)
+	snapshot, err := poolSnapshotFor(ctx, ado, m.Spec.Pool.PoolName)
+	if err != nil {
+		return err
+	}
+	pods, err := r.agentPods(ctx, m)
+	if err != nil {
+		return err
+	}
+	online, busy := 0, 0
+	for i := range pods {
+		a, ok := snapshot.registered[agentNameForPod(&pods[i])]
+		if !ok || a.Status != "online" {
+			continue
+		}
+		online++
+		if a.Busy() {
+			busy++
+		}
+	}
+	registeredAgentsGauge.WithLabelValues(m.Namespace, m.Name).Set(float64(online))
+	busyAgents.WithLabelValues(m.Namespace, m.Name).Set(float64(busy))
+
+	return r.recordJobMetrics(ctx, m, snapshot)
+}
+
+// recordJobMetrics exports the queue wait time, duration and result of the
+// jobs that completed on the agents of the Agent since the last export. The
+// finish time of the last exported job is kept in the Agent status so jobs
+// are not exported twice when the operator restarts.
+func (r *AgentReconciler) recordJobMetrics(ctx context.Context, m *azdevopsv1alpha1.Agent, snapshot *poolSnapshot) error {
+	if m.Status.LastJobFinishTime == nil {
+		// start exporting from now instead of the history of the pool
+		now := metav1.NowMicro()
+		m.Status.LastJobFinishTime = &now
+		return r.updateStatus(ctx, m)
+	}
+
+	agentName := agentNamePattern(m)
+	last := m.Status.LastJobFinishTime.Time
+	completed := []azdevops.JobRequest{}
+	for _, req := range snapshot.requests {
+		if req.FinishTime == nil || !req.FinishTime.After(m.Status.LastJobFinishTime.Time) {
+			continue
+		}
+		if req.ReservedAgent == nil || !agentName.MatchString(req.ReservedAgent.Name) {
+			continue
+		}
+		completed = append(completed, req)
+		if req.FinishTime.After(last) {
+			last = *req.FinishTime
+		}
+	}
+	if len(completed) == 0 {
+		return nil
+	}
+
+	// record the jobs as exported before observing them, a failed update
+	// exports them on the next attempt
+	m.Status.LastJobFinishTime = &metav1.MicroTime{Time: last}
+	if err := r.updateStatus(ctx, m); err != nil {
+		return err
+	}
+	pool := snapshot.pool.Name
+	for _, req := range completed {
+		if req.QueueTime != nil && req.AssignTime != nil {
+			trackSeries(jobQueueWait, m.Namespace, m.Name, pool)
+			jobQueueWait.WithLabelValues(m.Namespace, m.Name, pool).Observe(req.AssignTime.Sub(*req.QueueTime).Seconds())
+		}
+		started := req.ReceiveTime
+		if started == nil {
+			started = req.AssignTime
+		}
+		if started != nil {
+			trackSeries(jobDuration, m.Namespace, m.Name, pool)
+			jobDuration.WithLabelValues(m.Namespace, m.Name, pool).Observe(req.FinishTime.Sub(*started).Seconds())
+		}
+		trackSeries(jobResults, m.Namespace, m.Name, pool, req.Result)
+		jobResults.WithLabelValues(m.Namespace, m.Name, pool, req.Result).Inc()
+	}
+	return nil
+}
+
+// agentNamePattern matches the names the agent pods of the Agent register
+// with, including the canary pods and pods that are already removed
+func agentNamePattern(m *azdevopsv1alpha1.Agent) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(m.Name) + "(-canary)?-[a-z0-9]+-[a-z0-9]{5}$")
+}
+
+// deleteAgentMetrics removes all series of a deleted Agent
+func deleteAgentMetrics(namespace, agent string) {
+	desiredAgents.DeleteLabelValues(namespace, agent)
+	readyAgents.DeleteLabelValues(namespace, agent)
+	registeredAgentsGauge.DeleteLabelValues(namespace, agent)
+	busyAgents.DeleteLabelValues(namespace, agent)
+
+	agentSeries.Lock()
+	defer agentSeries.Unlock()
+	for key, labels := range agentSeries.series[namespace+"/"+agent] {
+		key.vec.DeleteLabelValues(labels...)
+	}
+	delete(agentSeries.series, namespace+"/"+agent)
+}
+
+// idSegment matches the numeric and guid path segments of the REST API
+var idSegment = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+
+// apiOperation turns a request path into a low cardinality operation label
+// like distributedtask/pools/{id}/agents, the organization and project are
+// left out
+func apiOperation(path string) string {
+	i := strings.Index(path, "/_apis/")
+	if i < 0 {
+		return "other"
+	}
+	segments := strings.Split(strings.Trim(path[i+len("/_apis/"):], "/"), "/")
+	for j, s := range segments {
+		if idSegment.MatchString(s) {
+			segments[j] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// instrumentedTransport records the latency and status code of every
+// request to Azure DevOps
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+// InstrumentTransport wraps next to export Azure DevOps request metrics
+func InstrumentTransport(next http.RoundTripper) http.RoundTripper {
+	return &instrumentedTransport{next: next}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	apiRequestDuration.WithLabelValues(req.Method, apiOperation(req.URL.Path), code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// tracer creates the spans of the reconcilers, it uses the global tracer
+// provider which does not record anything unless tracing is enabled
+var tracer = otel.Tracer("github.com/bartvanbenthem/azdevops-agent-operator/controllers")
+
+// startReconcileSpan starts the span of a reconciliation
+func startReconcileSpan(ctx context.Context, kind, namespace, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "Reconcile "+kind, trace.WithAttributes(
+		attribute.String("k8s.namespace.name", namespace),
+		attribute.String("azdevops.kind", kind),
+		attribute.String("azdevops.name", name),
+	))
+}
+
+// endSpan records err on the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceTransport wraps next to create a span for every request to Azure
+// DevOps, named after the method and operation of the request
+func TraceTransport(next http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(next, otelhttp.WithSpanNameFormatter(func(_ string, req *http.Request) string {
+		return req.Method + " " + apiOperation(req.URL.Path)
+	}))
+}
+
+// tracingClient creates a span for every request to the API server
+type tracingClient struct {
+	client.Client
+}
+
+// NewTracingClient wraps c to create a span for every request to the API
+// server, like Get Deployment or Update Secret
+func NewTracingClient(c client.Client) client.Client {
+	return &tracingClient{Client: c}
+}
+
+// startClientSpan starts the span of an API server request for obj
+func startClientSpan(ctx context.Context, operation string, obj interface{}) (context.Context, trace.Span) {
+	kind := reflect.TypeOf(obj).Elem().Name()
+	attrs := []attribute.KeyValue{attribute.String("k8s.kind", kind)}
+	if o, ok := obj.(client.Object); ok {
+		attrs = append(attrs,
+			attribute.String("k8s.namespace.name", o.GetNamespace()),
+			attribute.String("k8s.object.name", o.GetName()),
+		)
+	}
+	return tracer.Start(ctx, operation+" "+kind, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (c *tracingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) (err error) {
+	ctx, span := startClientSpan(ctx, "Get", obj)
+	span.SetAttributes(attribute.String("k8s.namespace.name", key.Namespace), attribute.String("k8s.object.name", key.Name))
+	defer func() { endSpan(span, client.IgnoreNotFound(err)) }()
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *tracingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) (err error) {
+	ctx, span := startClientSpan(ctx, "List", list)
+	defer func() { endSpan(span, err) }()
+	return c.Client.List(ctx, list, opts...)
+}
+
+func (c *tracingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) (err error) {
+	ctx, span := startClientSpan(ctx, "Create", obj)
+	defer func() { endSpan(span, err) }()
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) (err error) {
+	ctx, span := startClientSpan(ctx, "Update", obj)
+	defer func() { endSpan(span, err) }()
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) (err error) {
+	ctx, span := startClientSpan(ctx, "Patch", obj)
+	defer func() { endSpan(span, err) }()
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *tracingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) (err error) {
+	ctx, span := startClientSpan(ctx, "Delete", obj)
+	defer func() { endSpan(span, err) }()
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Status() client.StatusWriter {
+	return &tracingStatusWriter{StatusWriter: c.Client.Status()}
+}
+
+// tracingStatusWriter creates a span for every status update
+type tracingStatusWriter struct {
+	client.StatusWriter
+}
+
+func (w *tracingStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) (err error) {
+	ctx, span := startClientSpan(ctx, "UpdateStatus", obj)
+	defer func() { endSpan(span, err) }()
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+func (w *tracingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) (err error) {
+	ctx, span := startClientSpan(ctx, "PatchStatus", obj)
+	defer func() { endSpan(span, err) }()
+	return w.StatusWriter.Patch(ctx, obj, patch, opts...)
+}
@@ -17,22 +17,37 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"strings"
+	"time"
+	// Embed the time zone database for the schedule time zones, the
+	// distroless base image does not guarantee one
+	_ "time/tzdata"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	configv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/config/v1alpha1"
 	azdevopsv1alpha1 "github.com/bartvanbenthem/azdevops-agent-operator/api/v1alpha1"
 	"github.com/bartvanbenthem/azdevops-agent-operator/controllers"
+	"github.com/bartvanbenthem/azdevops-agent-operator/pkg/azdevops"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -45,6 +60,7 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(azdevopsv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(configv1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -52,11 +68,33 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var watchNamespaces string
+	var configFile string
+	var configReloadInterval time.Duration
+	var otlpEndpoint string
+	var otlpInsecure bool
+	var traceSampleRatio float64
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", os.Getenv("WATCH_NAMESPACES"),
+		"Comma separated list of namespaces the controller manager watches, all namespaces when empty. "+
+			"Defaults to the WATCH_NAMESPACES environment variable.")
+	flag.StringVar(&configFile, "config", "",
+		"The controller will load its initial configuration and the Agent defaults from this file. "+
+			"Omit this flag to use the default configuration values. "+
+			"Command-line flags override configuration from this file.")
+	flag.DurationVar(&configReloadInterval, "config-reload-interval", 30*time.Second,
+		"How often the configuration file is checked for changes to the Agent defaults.")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "",
+		"The OTLP gRPC endpoint traces are exported to, like localhost:4317. "+
+			"Tracing is enabled when this flag or the OTEL_EXPORTER_OTLP_ENDPOINT environment variable is set.")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false,
+		"Export traces without TLS, for example to a local collector.")
+	flag.Float64Var(&traceSampleRatio, "trace-sample-ratio", 1,
+		"The fraction of reconciliations that is traced.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -64,27 +102,120 @@ func main() {
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	ctx := ctrl.SetupSignalHandler()
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	shutdownTracing := func(context.Context) error { return nil }
+	if otlpEndpoint != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		var err error
+		shutdownTracing, err = setupTracing(ctx, otlpEndpoint, otlpInsecure, traceSampleRatio)
+		if err != nil {
+			setupLog.Error(err, "unable to set up tracing")
+			os.Exit(1)
+		}
+		setupLog.Info("exporting traces", "endpoint", otlpEndpoint)
+	}
+
+	options := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "103eeddf.gofound.nl",
-	})
+	}
+
+	operatorConfig := configv1alpha1.OperatorConfig{}
+	if configFile != "" {
+		// only flags set on the command-line override the configuration file
+		set := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		fileOptions := ctrl.Options{Scheme: scheme}
+		if set["metrics-bind-address"] {
+			fileOptions.MetricsBindAddress = metricsAddr
+		}
+		if set["health-probe-bind-address"] {
+			fileOptions.HealthProbeBindAddress = probeAddr
+		}
+		if set["leader-elect"] {
+			fileOptions.LeaderElection = enableLeaderElection
+		}
+		fileOptions, err := fileOptions.AndFrom(ctrl.ConfigFile().AtPath(configFile).OfKind(&operatorConfig))
+		if err != nil {
+			setupLog.Error(err, "unable to load the config file", "path", configFile)
+			os.Exit(1)
+		}
+		if fileOptions.MetricsBindAddress == "" {
+			fileOptions.MetricsBindAddress = metricsAddr
+		}
+		if fileOptions.HealthProbeBindAddress == "" {
+			fileOptions.HealthProbeBindAddress = probeAddr
+		}
+		if fileOptions.Port == 0 {
+			fileOptions.Port = options.Port
+		}
+		if fileOptions.LeaderElectionID == "" {
+			fileOptions.LeaderElectionID = options.LeaderElectionID
+		}
+		options = fileOptions
+	}
+
+	// restrict the cache and controllers to the watched namespaces
+	namespaces := splitNamespaces(watchNamespaces)
+	switch len(namespaces) {
+	case 0:
+		setupLog.Info("watching all namespaces")
+	case 1:
+		setupLog.Info("watching namespace", "namespace", namespaces[0])
+		options.Namespace = namespaces[0]
+	default:
+		setupLog.Info("watching namespaces", "namespaces", namespaces)
+		options.NewCache = cache.MultiNamespacedCacheBuilder(namespaces)
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	// export the latency and status codes of the Azure DevOps requests and
+	// trace them as part of the reconciliation
+	azdevops.Transport = controllers.TraceTransport(controllers.InstrumentTransport(azdevops.Transport))
+
+	defaults := controllers.NewAgentDefaults(operatorConfig.AgentDefaults)
+	configEvents := make(chan event.GenericEvent, 1024)
+	if configFile != "" {
+		if err = mgr.Add(&controllers.ConfigReloader{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Path:     configFile,
+			Interval: configReloadInterval,
+			Defaults: defaults,
+			Events:   configEvents,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up config reloader")
+			os.Exit(1)
+		}
+	}
+
 	if err = (&controllers.AgentReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:          controllers.NewTracingClient(mgr.GetClient()),
+		APIReader:       mgr.GetAPIReader(),
+		Scheme:          mgr.GetScheme(),
+		Defaults:        defaults,
+		WatchNamespaces: namespaces,
+		ConfigEvents:    configEvents,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Agent")
 		os.Exit(1)
 	}
+	if err = (&controllers.AgentPoolReconciler{
+		Client: controllers.NewTracingClient(mgr.GetClient()),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "AgentPool")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -97,8 +228,49 @@ func main() {
 	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		setupLog.Error(err, "unable to flush traces")
+	}
+}
+
+// splitNamespaces parses a comma separated list of namespaces
+func splitNamespaces(list string) []string {
+	namespaces := []string{}
+	for _, ns := range strings.Split(list, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
+
+// setupTracing exports the spans of the operator to an OTLP collector and
+// returns a function that flushes the remaining spans. The endpoint, TLS
+// and headers can also be set with the OTEL_EXPORTER_OTLP_* variables.
+func setupTracing(ctx context.Context, endpoint string, insecure bool, sampleRatio float64) (func(context.Context) error, error) {
+	opts := []otlptracegrpc.Option{}
+	if endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+	}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("azdevops-agent-operator"),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
 }
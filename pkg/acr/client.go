@@ -0,0 +1,205 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package acr contains a minimal client obtaining Azure Container Registry
+// tokens with an Azure AD workload identity.
+package acr
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultAuthorityHost is the Azure AD authority of the public cloud
+	defaultAuthorityHost = "https://login.microsoftonline.com/"
+	// armScope is the scope of the Azure AD token a registry exchanges
+	armScope = "https://management.azure.com/.default"
+	// Username is the user name that goes with a registry refresh token
+	Username = "00000000-0000-0000-0000-000000000000"
+)
+
+// hostName matches a bare lower case host name without port or path
+var hostName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// LoginServerAllowed returns true if the Azure AD token may be sent to
+// registry, a host name that is one of allowed
+func LoginServerAllowed(registry string, allowed []string) bool {
+	if !hostName.MatchString(registry) {
+		return false
+	}
+	for _, server := range allowed {
+		if server == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// Transport is used by the clients returned by NewClient
+var Transport http.RoundTripper = http.DefaultTransport
+
+// WorkloadIdentity holds the settings the Azure workload identity webhook
+// injects into a pod
+type WorkloadIdentity struct {
+	ClientID      string
+	TenantID      string
+	TokenFile     string
+	AuthorityHost string
+}
+
+// WorkloadIdentityFromEnv returns the workload identity of the current pod
+func WorkloadIdentityFromEnv() WorkloadIdentity {
+	return WorkloadIdentity{
+		ClientID:      os.Getenv("AZURE_CLIENT_ID"),
+		TenantID:      os.Getenv("AZURE_TENANT_ID"),
+		TokenFile:     os.Getenv("AZURE_FEDERATED_TOKEN_FILE"),
+		AuthorityHost: os.Getenv("AZURE_AUTHORITY_HOST"),
+	}
+}
+
+// Client obtains registry tokens for an Azure AD application trusting the
+// federated token of a workload identity
+type Client struct {
+	Identity WorkloadIdentity
+	// AllowedLoginServers are the login servers the Azure AD token is
+	// sent to
+	AllowedLoginServers []string
+	HTTPClient          *http.Client
+}
+
+// NewClient returns a Client for identity, it fails when the identity is
+// not complete
+func NewClient(identity WorkloadIdentity) (*Client, error) {
+	if identity.ClientID == "" || identity.TenantID == "" || identity.TokenFile == "" {
+		return nil, errors.New("acr: workload identity needs a client id, tenant id and federated token file")
+	}
+	if identity.AuthorityHost == "" {
+		identity.AuthorityHost = defaultAuthorityHost
+	}
+	return &Client{
+		Identity:   identity,
+		HTTPClient: &http.Client{Transport: Transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// AccessToken exchanges the federated token for an Azure AD access token
+func (c *Client) AccessToken(ctx context.Context) (string, error) {
+	assertion, err := ioutil.ReadFile(c.Identity.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"client_id":             {c.Identity.ClientID},
+		"grant_type":            {"client_credentials"},
+		"scope":                 {armScope},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+	}
+	endpoint := strings.TrimSuffix(c.Identity.AuthorityHost, "/") + "/" + url.PathEscape(c.Identity.TenantID) + "/oauth2/v2.0/token"
+	out := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := c.post(ctx, endpoint, form, &out); err != nil {
+		return "", err
+	}
+	return out.AccessToken, nil
+}
+
+// RefreshToken exchanges an Azure AD access token for a refresh token of
+// the registry login server, it returns the token and when it expires
+func (c *Client) RefreshToken(ctx context.Context, registry, accessToken string) (string, time.Time, error) {
+	if !LoginServerAllowed(registry, c.AllowedLoginServers) {
+		return "", time.Time{}, fmt.Errorf("acr: %q is not an allowed Azure Container Registry login server", registry)
+	}
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {registry},
+		"tenant":       {c.Identity.TenantID},
+		"access_token": {accessToken},
+	}
+	out := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := c.post(ctx, "https://"+registry+"/oauth2/exchange", form, &out); err != nil {
+		return "", time.Time{}, err
+	}
+	expires, err := tokenExpiry(out.RefreshToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return out.RefreshToken, expires, nil
+}
+
+// post sends form to endpoint and decodes the JSON response into out
+func (c *Client) post(ctx context.Context, endpoint string, form url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("acr: %s: status %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// tokenExpiry reads the expiry of a JWT, the signature is not verified as
+// the token is only passed on to the registry
+func tokenExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("acr: refresh token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	claims := struct {
+		Exp int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, err
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, errors.New("acr: refresh token has no expiry")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azdevops
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Pool is an organization level agent pool
+type Pool struct {
+	ID   int    `json:"id,omitempty"`
+	Name string `json:"name"`
+	// AutoProvision creates a queue for the pool in every new project
+	AutoProvision *bool `json:"autoProvision,omitempty"`
+	// AutoUpdate lets Azure DevOps update the agents in the pool
+	AutoUpdate *bool `json:"autoUpdate,omitempty"`
+}
+
+// Agent is a self-hosted agent registered in a pool
+type Agent struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Enabled bool   `json:"enabled"`
+	// Status is either online or offline
+	Status string `json:"status,omitempty"`
+	// AssignedRequest is set while the agent is running a job
+	AssignedRequest *JobRequest `json:"assignedRequest,omitempty"`
+}
+
+// Busy returns true if the agent is running a job
+func (a *Agent) Busy() bool {
+	return a.AssignedRequest != nil
+}
+
+// JobRequest is a job that is queued, running or finished on a pool
+type JobRequest struct {
+	RequestID int `json:"requestId"`
+	// QueueTime is when the job was queued
+	QueueTime *time.Time `json:"queueTime,omitempty"`
+	// AssignTime is when an agent was assigned to the job
+	AssignTime *time.Time `json:"assignTime,omitempty"`
+	// ReceiveTime is when the agent started the job
+	ReceiveTime *time.Time `json:"receiveTime,omitempty"`
+	// FinishTime is set once the job completed
+	FinishTime *time.Time `json:"finishTime,omitempty"`
+	// Result is succeeded, succeededWithIssues, failed, canceled, skipped
+	// or abandoned once the job completed
+	Result string `json:"result,omitempty"`
+	// ReservedAgent is the agent running the job
+	ReservedAgent *Agent `json:"reservedAgent,omitempty"`
+}
+
+// GetPoolByName returns the agent pool with the given name
+func (c *Client) GetPoolByName(ctx context.Context, name string) (*Pool, error) {
+	pools := []Pool{}
+	path := "/_apis/distributedtask/pools?poolName=" + url.QueryEscape(name)
+	if err := c.list(ctx, path, &pools); err != nil {
+		return nil, err
+	}
+	if len(pools) == 0 {
+		return nil, &Error{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("pool %q not found", name)}
+	}
+	return &pools[0], nil
+}
+
+// ListAgents returns the agents registered in a pool including the job
+// they are currently running.
+func (c *Client) ListAgents(ctx context.Context, poolID int) ([]Agent, error) {
+	agents := []Agent{}
+	path := fmt.Sprintf("/_apis/distributedtask/pools/%d/agents?includeAssignedRequest=true", poolID)
+	if err := c.list(ctx, path, &agents); err != nil {
+		return nil, err
+	}
+	return agents, nil
+}
+
+// ListJobRequests returns the running jobs of a pool and the last completed
+// jobs, up to completed
+func (c *Client) ListJobRequests(ctx context.Context, poolID, completed int) ([]JobRequest, error) {
+	requests := []JobRequest{}
+	path := fmt.Sprintf("/_apis/distributedtask/pools/%d/jobrequests?completedRequestCount=%d", poolID, completed)
+	if err := c.list(ctx, path, &requests); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// SetAgentEnabled enables or disables an agent, a disabled agent
+// does not receive new jobs.
+func (c *Client) SetAgentEnabled(ctx context.Context, poolID, agentID int, enabled bool) error {
+	path := fmt.Sprintf("/_apis/distributedtask/pools/%d/agents/%d", poolID, agentID)
+	body := map[string]interface{}{"id": agentID, "enabled": enabled}
+	return c.do(ctx, http.MethodPatch, path, body, nil)
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package azdevops contains a minimal client for the Azure DevOps REST API,
+// covering the calls the operator needs to manage self-hosted agents.
+package azdevops
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIVersion is the Azure DevOps REST API version used for all requests
+const APIVersion = "6.0"
+
+// Transport is used by the clients returned by NewClient, it can be wrapped
+// to instrument all requests to Azure DevOps
+var Transport http.RoundTripper = http.DefaultTransport
+
+// Client talks to the Azure DevOps organization or collection at URL
+// and authenticates with a personal access token.
+type Client struct {
+	URL        string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a Client for the organization URL authenticating with token
+func NewClient(url, token string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(url, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Transport: Transport, Timeout: 30 * time.Second},
+	}
+}
+
+// Error is returned when Azure DevOps responds with a non 2xx status code
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("azure devops: status %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound returns true if err is an Azure DevOps 404 response
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// listResponse is the envelope Azure DevOps wraps around collections
+type listResponse struct {
+	Count int             `json:"count"`
+	Value json.RawMessage `json:"value"`
+}
+
+// do sends a request to path (relative to the organization URL) and decodes
+// the JSON response into out when out is not nil. Paths without an
+// api-version parameter use APIVersion.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	url := c.URL + path
+	if !strings.Contains(path, "api-version=") {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		url += sep + "api-version=" + APIVersion
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(":" + c.Token))
+	req.Header.Set("Authorization", "Basic "+auth)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// list fetches a collection and decodes its values into out
+func (c *Client) list(ctx context.Context, path string, out interface{}) error {
+	resp := listResponse{}
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return err
+	}
+	if len(resp.Value) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Value, out)
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azdevops
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// API versions of the environment and service endpoint calls, which are
+// only available as preview
+const (
+	environmentAPIVersion     = "6.0-preview.1"
+	serviceEndpointAPIVersion = "6.0-preview.4"
+)
+
+// Project is an Azure DevOps project
+type Project struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Environment is a project level deployment target used for approvals and
+// deployment history
+type Environment struct {
+	ID          int    `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// KubernetesResource is a namespace registered in an Environment
+type KubernetesResource struct {
+	ID                int    `json:"id,omitempty"`
+	Name              string `json:"name"`
+	Namespace         string `json:"namespace"`
+	ClusterName       string `json:"clusterName,omitempty"`
+	ServiceEndpointID string `json:"serviceEndpointId"`
+}
+
+// ServiceEndpoint is a service connection Azure DevOps uses to reach an
+// external service like a Kubernetes cluster
+type ServiceEndpoint struct {
+	ID            string                            `json:"id,omitempty"`
+	Name          string                            `json:"name"`
+	Type          string                            `json:"type"`
+	URL           string                            `json:"url"`
+	Authorization EndpointAuthorization             `json:"authorization"`
+	Data          map[string]string                 `json:"data,omitempty"`
+	References    []ServiceEndpointProjectReference `json:"serviceEndpointProjectReferences"`
+}
+
+// EndpointAuthorization holds the credentials of a ServiceEndpoint
+type EndpointAuthorization struct {
+	Scheme     string            `json:"scheme"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// ServiceEndpointProjectReference shares a ServiceEndpoint with a project
+type ServiceEndpointProjectReference struct {
+	ProjectReference Project `json:"projectReference"`
+	Name             string  `json:"name"`
+}
+
+// GetProject returns the project with the given name or id
+func (c *Client) GetProject(ctx context.Context, name string) (*Project, error) {
+	project := &Project{}
+	if err := c.do(ctx, http.MethodGet, "/_apis/projects/"+url.PathEscape(name), nil, project); err != nil {
+		return nil, err
+	}
+	return project, nil
+}
+
+// GetEnvironmentByName returns the environment with the given name in a project
+func (c *Client) GetEnvironmentByName(ctx context.Context, project, name string) (*Environment, error) {
+	environments := []Environment{}
+	path := fmt.Sprintf("/%s/_apis/distributedtask/environments?name=%s&api-version=%s",
+		url.PathEscape(project), url.QueryEscape(name), environmentAPIVersion)
+	if err := c.list(ctx, path, &environments); err != nil {
+		return nil, err
+	}
+	if len(environments) == 0 {
+		return nil, &Error{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("environment %q not found", name)}
+	}
+	return &environments[0], nil
+}
+
+// CreateEnvironment creates an environment in a project
+func (c *Client) CreateEnvironment(ctx context.Context, project string, environment *Environment) (*Environment, error) {
+	created := &Environment{}
+	path := fmt.Sprintf("/%s/_apis/distributedtask/environments?api-version=%s",
+		url.PathEscape(project), environmentAPIVersion)
+	if err := c.do(ctx, http.MethodPost, path, environment, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// GetKubernetesResource returns a Kubernetes resource of an environment
+func (c *Client) GetKubernetesResource(ctx context.Context, project string, environmentID, resourceID int) (*KubernetesResource, error) {
+	resource := &KubernetesResource{}
+	path := fmt.Sprintf("/%s/_apis/distributedtask/environments/%d/providers/kubernetes/%d?api-version=%s",
+		url.PathEscape(project), environmentID, resourceID, environmentAPIVersion)
+	if err := c.do(ctx, http.MethodGet, path, nil, resource); err != nil {
+		return nil, err
+	}
+	return resource, nil
+}
+
+// CreateKubernetesResource registers a namespace in an environment
+func (c *Client) CreateKubernetesResource(ctx context.Context, project string, environmentID int, resource *KubernetesResource) (*KubernetesResource, error) {
+	created := &KubernetesResource{}
+	path := fmt.Sprintf("/%s/_apis/distributedtask/environments/%d/providers/kubernetes?api-version=%s",
+		url.PathEscape(project), environmentID, environmentAPIVersion)
+	if err := c.do(ctx, http.MethodPost, path, resource, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// DeleteKubernetesResource removes a namespace from an environment, the
+// deployment history of the environment is kept
+func (c *Client) DeleteKubernetesResource(ctx context.Context, project string, environmentID, resourceID int) error {
+	path := fmt.Sprintf("/%s/_apis/distributedtask/environments/%d/providers/kubernetes/%d?api-version=%s",
+		url.PathEscape(project), environmentID, resourceID, environmentAPIVersion)
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// CreateServiceEndpoint creates a service endpoint shared with the projects
+// in its references
+func (c *Client) CreateServiceEndpoint(ctx context.Context, endpoint *ServiceEndpoint) (*ServiceEndpoint, error) {
+	created := &ServiceEndpoint{}
+	path := "/_apis/serviceendpoint/endpoints?api-version=" + serviceEndpointAPIVersion
+	if err := c.do(ctx, http.MethodPost, path, endpoint, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// UpdateServiceEndpoint replaces the url and credentials of a service endpoint
+func (c *Client) UpdateServiceEndpoint(ctx context.Context, endpoint *ServiceEndpoint) (*ServiceEndpoint, error) {
+	updated := &ServiceEndpoint{}
+	path := fmt.Sprintf("/_apis/serviceendpoint/endpoints/%s?api-version=%s",
+		url.PathEscape(endpoint.ID), serviceEndpointAPIVersion)
+	if err := c.do(ctx, http.MethodPut, path, endpoint, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteServiceEndpoint deletes a service endpoint from the given projects
+func (c *Client) DeleteServiceEndpoint(ctx context.Context, endpointID, projectID string) error {
+	path := fmt.Sprintf("/_apis/serviceendpoint/endpoints/%s?projectIds=%s&api-version=%s",
+		url.PathEscape(endpointID), url.QueryEscape(projectID), serviceEndpointAPIVersion)
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azdevops
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// packagesAPIVersion is the API version of the agent packages, which are
+// only available as preview
+const packagesAPIVersion = "6.0-preview.2"
+
+// Package is a downloadable release of the agent software
+type Package struct {
+	Type        string         `json:"type"`
+	Platform    string         `json:"platform"`
+	Version     PackageVersion `json:"version"`
+	DownloadURL string         `json:"downloadUrl"`
+	Filename    string         `json:"filename,omitempty"`
+	HashValue   string         `json:"hashValue,omitempty"`
+}
+
+// PackageVersion is the semantic version of a Package
+type PackageVersion struct {
+	Major int `json:"major"`
+	Minor int `json:"minor"`
+	Patch int `json:"patch"`
+}
+
+func (v PackageVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Less returns true if v is an older version than o
+func (v PackageVersion) Less(o PackageVersion) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+// ParsePackageVersion parses a major.minor.patch version, missing parts
+// are zero
+func ParsePackageVersion(s string) (PackageVersion, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) > 3 {
+		return PackageVersion{}, fmt.Errorf("invalid agent version %q", s)
+	}
+	numbers := [3]int{}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return PackageVersion{}, fmt.Errorf("invalid agent version %q", s)
+		}
+		numbers[i] = n
+	}
+	return PackageVersion{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, nil
+}
+
+// ListAgentPackages returns the agent packages available for a platform,
+// like linux-x64, newest first
+func (c *Client) ListAgentPackages(ctx context.Context, platform string) ([]Package, error) {
+	packages := []Package{}
+	path := fmt.Sprintf("/_apis/distributedtask/packages/agent?platform=%s&api-version=%s",
+		url.QueryEscape(platform), packagesAPIVersion)
+	if err := c.list(ctx, path, &packages); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(packages, func(i, j int) bool {
+		return packages[j].Version.Less(packages[i].Version)
+	})
+	return packages, nil
+}
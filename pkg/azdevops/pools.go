@@ -0,0 +1,133 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azdevops
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// API versions of the project level queue and pipeline permission calls,
+// which are only available as preview
+const (
+	queueAPIVersion      = "6.0-preview.1"
+	permissionAPIVersion = "6.1-preview.1"
+)
+
+// Queue makes an organization level pool available in a project
+type Queue struct {
+	ID   int    `json:"id,omitempty"`
+	Name string `json:"name"`
+	Pool *Pool  `json:"pool,omitempty"`
+}
+
+// CreatePool creates an organization level agent pool
+func (c *Client) CreatePool(ctx context.Context, pool *Pool) (*Pool, error) {
+	body := map[string]interface{}{
+		"name":     pool.Name,
+		"poolType": "automation",
+	}
+	if pool.AutoProvision != nil {
+		body["autoProvision"] = *pool.AutoProvision
+	}
+	if pool.AutoUpdate != nil {
+		body["autoUpdate"] = *pool.AutoUpdate
+	}
+	created := &Pool{}
+	if err := c.do(ctx, http.MethodPost, "/_apis/distributedtask/pools", body, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// GetPool returns the agent pool with the given id
+func (c *Client) GetPool(ctx context.Context, poolID int) (*Pool, error) {
+	pool := &Pool{}
+	path := fmt.Sprintf("/_apis/distributedtask/pools/%d", poolID)
+	if err := c.do(ctx, http.MethodGet, path, nil, pool); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// UpdatePool updates the name, auto-provision and auto-update settings of
+// a pool
+func (c *Client) UpdatePool(ctx context.Context, pool *Pool) (*Pool, error) {
+	body := map[string]interface{}{}
+	if pool.Name != "" {
+		body["name"] = pool.Name
+	}
+	if pool.AutoProvision != nil {
+		body["autoProvision"] = *pool.AutoProvision
+	}
+	if pool.AutoUpdate != nil {
+		body["autoUpdate"] = *pool.AutoUpdate
+	}
+	updated := &Pool{}
+	path := fmt.Sprintf("/_apis/distributedtask/pools/%d", pool.ID)
+	if err := c.do(ctx, http.MethodPatch, path, body, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeletePool deletes an organization level agent pool and its queues
+func (c *Client) DeletePool(ctx context.Context, poolID int) error {
+	path := fmt.Sprintf("/_apis/distributedtask/pools/%d", poolID)
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// ListQueues returns the queues of a pool in a project
+func (c *Client) ListQueues(ctx context.Context, project string, poolID int) ([]Queue, error) {
+	queues := []Queue{}
+	path := fmt.Sprintf("/%s/_apis/distributedtask/queues?poolIds=%d&api-version=%s",
+		url.PathEscape(project), poolID, queueAPIVersion)
+	if err := c.list(ctx, path, &queues); err != nil {
+		return nil, err
+	}
+	return queues, nil
+}
+
+// CreateQueue makes a pool available in a project
+func (c *Client) CreateQueue(ctx context.Context, project string, queue *Queue) (*Queue, error) {
+	created := &Queue{}
+	path := fmt.Sprintf("/%s/_apis/distributedtask/queues?api-version=%s",
+		url.PathEscape(project), queueAPIVersion)
+	if err := c.do(ctx, http.MethodPost, path, queue, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// DeleteQueue removes a pool from a project, the pool itself is kept
+func (c *Client) DeleteQueue(ctx context.Context, project string, queueID int) error {
+	path := fmt.Sprintf("/%s/_apis/distributedtask/queues/%d?api-version=%s",
+		url.PathEscape(project), queueID, queueAPIVersion)
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// AuthorizeQueue allows or denies all pipelines in a project to use a queue
+func (c *Client) AuthorizeQueue(ctx context.Context, project string, queueID int, authorized bool) error {
+	path := fmt.Sprintf("/%s/_apis/pipelines/pipelinepermissions/queue/%d?api-version=%s",
+		url.PathEscape(project), queueID, permissionAPIVersion)
+	body := map[string]interface{}{
+		"allPipelines": map[string]interface{}{"authorized": authorized},
+	}
+	return c.do(ctx, http.MethodPatch, path, body, nil)
+}